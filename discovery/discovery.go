@@ -4,13 +4,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/mux"
 	"go.etcd.io/etcd/client/v3"
@@ -29,6 +33,7 @@ type kvstorage struct {
 
 type appDiscoveryMeta struct {
 	ID           string `json:"id"`
+	AppID        string `json:"app_id,omitempty"` // ID in the catalog of the server
 	AppName      string `json:"app_name"`
 	Addr         string `json:"addr"`
 	AppMode      string `json:"app_mode"`
@@ -96,7 +101,8 @@ func NewStorage(addr string) kvstorage {
 		DialTimeout: dialTimeout,
 	})
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Cannot connect to etcd", "addr", etcdAddr, "err", err)
+		os.Exit(1)
 	}
 	//defer cli.Close() // make sure to close the client
 	kv := clientv3.NewKV(cli)
@@ -152,7 +158,7 @@ func (d *appDiscovery) getApps() []appDiscoveryMeta {
 func (s *server) isValidIP(addr string) bool {
 	ipAddr := strings.Split(addr, ":")[0]
 	if isPrivateIP(net.ParseIP(ipAddr)) {
-		log.Println("Skip Private IP", addr)
+		slog.Debug("Skipped a private IP", "addr", addr)
 		return false
 	}
 	if !s.isAlive(addr) {
@@ -165,7 +171,7 @@ func (s *server) isAlive(addr string) bool {
 	for i := 1; i < 5; i++ {
 		response, err := http.Get(fmt.Sprintf("http://%s/%s", addr, "echo"))
 		if err != nil {
-			log.Println(err)
+			slog.Debug("App is not responding", "addr", addr, "err", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
@@ -201,11 +207,11 @@ func (s *server) refineAppsList() {
 		apps := s.discovery.getApps()
 		for _, app := range apps {
 			if _, ok := appsMap[app.Addr]; ok {
-				log.Println("Removed duplicated ", app)
+				slog.Info("Removed a duplicated app", logging.KeyApp, app.AppName, "id", app.ID, "addr", app.Addr)
 				// if existed => remove the redundant
 				err := s.discovery.removeApp(app.ID)
 				if err != nil {
-					log.Println(err)
+					slog.Warn("Cannot remove the app", "id", app.ID, "err", err)
 					continue
 				}
 				continue
@@ -216,10 +222,10 @@ func (s *server) refineAppsList() {
 		// Remove dead services
 		for _, app := range apps {
 			if !s.isValidIP(app.Addr) {
-				log.Println("Removed Dead service ", app)
+				slog.Info("Removed a dead app", logging.KeyApp, app.AppName, "id", app.ID, "addr", app.Addr)
 				err := s.discovery.removeApp(app.ID)
 				if err != nil {
-					log.Println(err)
+					slog.Warn("Cannot remove the app", "id", app.ID, "err", err)
 					continue
 				}
 				continue
@@ -250,7 +256,6 @@ func initializePrivateIPBlocks() {
 func (s *server) register(w http.ResponseWriter, r *http.Request) {
 	var h appDiscoveryMeta
 
-	log.Println("Received Register Request", h)
 	// Try to decode the request body into the struct. If there is an error,
 	// respond to the client with the error message and a 400 status code.
 	err := json.NewDecoder(r.Body).Decode(&h)
@@ -258,6 +263,7 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	slog.Info("Received a register request", logging.KeyApp, h.AppName, "addr", h.Addr)
 	if !s.isValidIP(h.Addr) {
 		return
 	}
@@ -280,7 +286,7 @@ func (s *server) remove(w http.ResponseWriter, r *http.Request) {
 	// Try to decode the request body into the struct. If there is an error,
 	// respond to the client with the error message and a 400 status code.
 	err := json.NewDecoder(r.Body).Decode(&appID)
-	log.Println("Received Remove Request", appID, err)
+	slog.Info("Received a remove request", "id", appID, "err", err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -300,7 +306,7 @@ func (s *server) getApps(w http.ResponseWriter, r *http.Request) {
 		Apps: s.discovery.getApps(),
 	}
 
-	log.Println("Received GetApps Request")
+	slog.Debug("Received a get apps request")
 	encodedResp, err := json.Marshal(resp)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -342,11 +348,17 @@ func NewServer() server {
 }
 
 func (s *server) Run() {
-	fmt.Println("Listening at", addr)
+	slog.Info("Listening", "addr", addr)
 	s.httpServer.ListenAndServe()
 }
 
 func main() {
+	logConfig := config.LogConfig{}
+	flag.StringVar(&logConfig.Level, "log-level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&logConfig.Format, "log-format", config.LogFormatText, "log format: text or json")
+	flag.Parse()
+	logging.Setup(logConfig)
+
 	s := NewServer()
 	s.Run()
 }
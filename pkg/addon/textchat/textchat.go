@@ -2,10 +2,11 @@ package textchat
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 )
 
 type ChatMessage struct {
@@ -52,6 +53,7 @@ func (t *TextChat) broadcast(e ChatMessage) error {
 		}, nil)
 	}
 	t.chatMsgs = append(t.chatMsgs, e)
+	metrics.ChatMessages.Inc()
 
 	return nil
 }
@@ -84,7 +86,7 @@ func (t *TextChat) AddClient(clientID string, ws *cws.Client) *chatClient {
 func (t *TextChat) SendChatHistory(clientID string) {
 	client, ok := t.clients[clientID]
 	if !ok {
-		fmt.Println("Client not found", clientID)
+		slog.Warn("Chat client not found", logging.KeyClient, clientID)
 		return
 	}
 
@@ -94,7 +96,7 @@ func (t *TextChat) SendChatHistory(clientID string) {
 			Message: msg.Message,
 		})
 		if err != nil {
-			log.Println("Failed to send ", msg)
+			slog.Warn("Cannot encode the chat message", logging.KeyClient, clientID, "err", err)
 			continue
 		}
 
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net"
 
 	"gopkg.in/yaml.v2"
@@ -20,6 +21,26 @@ type Config struct {
 	ScreenWidth  int    `yaml:"screenWidth"`  // Default: 800
 	ScreenHeight int    `yaml:"screenHeight"` // Default: 600
 	IsWindowMode *bool  `yaml:"isWindowMode"`
+	// Bounds of the screen size players may request at runtime
+	Resize ResizeConfig `yaml:"resize"`
+	// Capacity: 0 is unlimited. Clients over maxClients wait in a queue,
+	// clients over maxPlayers only watch
+	MaxClients int `yaml:"maxClients"`
+	MaxPlayers int `yaml:"maxPlayers"`
+	// How the app is launched
+	Launcher LauncherConfig `yaml:"launcher"`
+	// Confinement of the app container
+	Sandbox SandboxConfig `yaml:"sandbox"`
+	// Action on idle session
+	Idle IdleConfig `yaml:"idle"`
+	// Input events per second of a player. Default: 0 (unlimited)
+	InputRateLimit int `yaml:"inputRateLimit"`
+	// Seconds a dropped client keeps its seat to resume its session. Default: 30, negative to disable
+	ReconnectGrace int `yaml:"reconnectGrace"`
+	// Restart the app when a reload of the config changes app fields
+	RestartOnReload bool `yaml:"restartOnReload"`
+	// Pool of dedicated app instances, used when appMode is ondemand
+	OnDemand OnDemandConfig `yaml:"onDemand"`
 	// Discovery service
 	DiscoveryHost string `yaml:"discoveryHost"`
 	InstanceAddr  string `yaml:"instanceAddr"`
@@ -29,16 +50,175 @@ type Config struct {
 	// WebRTC config
 	StunTurn   string `yaml:"stunturn"` // Default: Google STUN, disable it with the "none" value
 	VideoCodec string `yaml:"videoCodec"`
+	// STUN/TURN servers with credentials, replace stunturn
+	ICEServers []ICEServerConfig `yaml:"iceServers"`
+	// Embedded TURN relay advertised to the clients
+	TURN TURNConfig `yaml:"turn"`
 	// Virtualization mode: To use in Windows. Linux is already fully virtualized with Docker+Wine
 	IsVirtualized bool `yaml:"virtualize"`
 	// Optional 1:1 NAT mapping
 	NAT1To1IP           string `yaml:"nat1to1ip"`
 	DisableInterceptors bool   `yaml:"disableInterceptors"`
+	// Websocket authentication
+	Auth AuthConfig `yaml:"auth"`
+	// Optional catalog of apps served side by side, see Catalog
+	Apps []AppConfig `yaml:"apps"`
+	// Logger of the process
+	Log LogConfig `yaml:"log"`
+}
+
+// redacted replaces the secrets of the config in the log lines
+const redacted = "REDACTED"
+
+// LogValue logs the config without its secrets: the token secret, the static tokens
+// and the credentials of the ICE servers
+func (c Config) LogValue() slog.Value {
+	if c.Auth.Secret != "" {
+		c.Auth.Secret = redacted
+	}
+	if len(c.Auth.StaticTokens) > 0 {
+		c.Auth.StaticTokens = map[string]string{redacted: redacted}
+	}
+	servers := make([]ICEServerConfig, len(c.ICEServers))
+	for i, s := range c.ICEServers {
+		if s.Credential != "" {
+			s.Credential = redacted
+		}
+		if s.Secret != "" {
+			s.Secret = redacted
+		}
+		servers[i] = s
+	}
+	c.ICEServers = servers
+	// without the LogValue method
+	type config Config
+	return slog.AnyValue(config(c))
+}
+
+// AppConfig is an app of the catalog. Empty fields fall back to the top level config.
+type AppConfig struct {
+	ID           string          `yaml:"id"` // Served at /ws/{id} and /embed/{id}
+	Path         string          `yaml:"path"`
+	AppFile      string          `yaml:"appFile"`
+	WindowTitle  string          `yaml:"windowTitle"`
+	HWKey        *bool           `yaml:"hardwareKey"`
+	AppMode      string          `yaml:"appMode"`
+	AppName      string          `yaml:"appName"` // Default: windowTitle of the app
+	PageTitle    string          `yaml:"pageTitle"`
+	ScreenWidth  int             `yaml:"screenWidth"`
+	ScreenHeight int             `yaml:"screenHeight"`
+	IsWindowMode *bool           `yaml:"isWindowMode"`
+	Resize       *ResizeConfig   `yaml:"resize"`
+	HasChat      *bool           `yaml:"hasChat"`
+	VideoCodec   string          `yaml:"videoCodec"`
+	Launcher     *LauncherConfig `yaml:"launcher"`
+	OnDemand     *OnDemandConfig `yaml:"onDemand"`
+}
+
+// App is an app served by the server with its resolved config
+type App struct {
+	// ID is empty for the app of a config without catalog
+	ID     string
+	Config Config
+}
+
+// LauncherConfig selects how app instances are started
+type LauncherConfig struct {
+	Type       string   `yaml:"type"`       // script/process/docker. Default: script
+	Image      string   `yaml:"image"`      // Docker image of the app VM. Default: syncwine
+	DockerHost string   `yaml:"dockerHost"` // Docker Engine API. Default: unix:///var/run/docker.sock
+	Command    []string `yaml:"command"`    // Optional: command of the process/container
+}
+
+// ResizeConfig bounds the screen size requested by players. Resize is off unless the max size is set.
+type ResizeConfig struct {
+	MinWidth  int `yaml:"minWidth"`  // Default: 320
+	MinHeight int `yaml:"minHeight"` // Default: 240
+	MaxWidth  int `yaml:"maxWidth"`
+	MaxHeight int `yaml:"maxHeight"`
+}
+
+// Enabled returns true if players may resize the screen
+func (c ResizeConfig) Enabled() bool {
+	return c.MaxWidth > 0 || c.MaxHeight > 0
+}
+
+// SandboxConfig confines the app container run by the script/docker launcher.
+// Empty config keeps the privileged container on the host network.
+type SandboxConfig struct {
+	CPUs      float64 `yaml:"cpus"`      // Default: 0 (unlimited)
+	MemoryMB  int64   `yaml:"memoryMB"`  // Default: 0 (unlimited)
+	PidsLimit int64   `yaml:"pidsLimit"` // Default: 0 (unlimited)
+	// Run without --privileged, with all capabilities dropped but capAdd and no-new-privileges
+	DropPrivileges bool     `yaml:"dropPrivileges"`
+	CapAdd         []string `yaml:"capAdd"`
+	Network        string   `yaml:"network"`  // Dedicated bridge network, created if missing. Default: host network
+	Internal       bool     `yaml:"internal"` // The bridge network has no outbound access
+	// Mount the apps read-only, the app writes to an overlay kept per instance in overlayDir
+	ReadOnlyApps bool   `yaml:"readOnlyApps"`
+	OverlayDir   string `yaml:"overlayDir"` // Default: overlay
+}
+
+// ICEServerConfig is a STUN/TURN server. TURN credentials are either static or
+// generated per user from the secret shared with the TURN server (TURN REST API).
+type ICEServerConfig struct {
+	URLs       []string `yaml:"urls"` // stun:, stuns:, turn: or turns: URLs
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+	Secret     string   `yaml:"secret"` // ex. static-auth-secret of coturn
+	TTL        int      `yaml:"ttl"`    // Seconds the generated credentials are valid. Default: 86400
+}
+
+// TURNConfig runs a TURN relay in the server. Clients get credentials valid for ttl.
+type TURNConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Port         int    `yaml:"port"`         // UDP and TCP port. Default: 3478
+	PublicIP     string `yaml:"publicIP"`     // Relay address given to the peers. Default: IP of instanceAddr
+	Realm        string `yaml:"realm"`        // Default: cloudmorph
+	MinRelayPort int    `yaml:"minRelayPort"` // Default: 49160
+	MaxRelayPort int    `yaml:"maxRelayPort"` // Default: 49200
+	TTL          int    `yaml:"ttl"`          // Seconds. Default: 600
+}
+
+// IdleConfig triggers an action when the session has no input or no viewer for a while
+type IdleConfig struct {
+	InputTimeout int    `yaml:"inputTimeout"` // Seconds without input or join/leave. Default: 0 (off)
+	EmptyTimeout int    `yaml:"emptyTimeout"` // Seconds without any viewer. Default: 0 (off)
+	Action       string `yaml:"action"`       // notify/restart/shutdown. Default: notify
+}
+
+// OnDemandConfig sizes the pool of per-user app instances
+type OnDemandConfig struct {
+	PrewarmInstances int `yaml:"prewarmInstances"` // Idle instances kept ready. Default: 1
+	MaxInstances     int `yaml:"maxInstances"`     // Default: 4
+	GracePeriod      int `yaml:"gracePeriod"`      // Seconds an instance is kept after its user left. Default: 60
+}
+
+// AuthConfig guards the websocket endpoints. Empty config keeps them open.
+type AuthConfig struct {
+	AllowedOrigins []string `yaml:"allowedOrigins"` // Origin or host, "*" for any including none. Default: any
+	Secret         string   `yaml:"secret"`         // HMAC secret to sign HS256 join tokens
+	TokenTTL       int      `yaml:"tokenTTL"`       // Seconds since issued. Default: 3600
+	// Local stand-in for an identity provider: token -> user
+	StaticTokens map[string]string `yaml:"staticTokens"`
+}
+
+// Formats of the log lines
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogConfig sets the level and the format of the log lines
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug/info/warn/error. Default: info
+	Format string `yaml:"format"` // text/json. Default: text
 }
 
 // TODO: sync with discovery.go
 type AppDiscoveryMeta struct {
 	ID           string `json:"id"`
+	AppID        string `json:"app_id,omitempty"` // ID in the catalog of the server
 	AppName      string `json:"app_name"`
 	Addr         string `json:"addr"`
 	AppMode      string `json:"app_mode"`
@@ -48,18 +228,121 @@ type AppDiscoveryMeta struct {
 	ScreenHeight int    `json:"screen_height"`
 }
 
+// Catalog returns the apps to serve. The first app is the default one.
+// Without an apps list, the config itself is the only app.
+func (c Config) Catalog() []App {
+	if len(c.Apps) == 0 {
+		return []App{{Config: c}}
+	}
+
+	apps := make([]App, 0, len(c.Apps))
+	for _, a := range c.Apps {
+		cfg := c
+		cfg.Apps = nil
+		if a.Path != "" {
+			cfg.Path = a.Path
+		}
+		if a.AppFile != "" {
+			cfg.AppFile = a.AppFile
+		}
+		if a.WindowTitle != "" {
+			cfg.WindowTitle = a.WindowTitle
+			cfg.AppName = a.WindowTitle
+		}
+		if a.AppName != "" {
+			cfg.AppName = a.AppName
+		}
+		if a.HWKey != nil {
+			cfg.HWKey = *a.HWKey
+		}
+		if a.AppMode != "" {
+			cfg.AppMode = a.AppMode
+		}
+		if a.PageTitle != "" {
+			cfg.PageTitle = a.PageTitle
+		}
+		if a.ScreenWidth != 0 {
+			cfg.ScreenWidth = a.ScreenWidth
+		}
+		if a.ScreenHeight != 0 {
+			cfg.ScreenHeight = a.ScreenHeight
+		}
+		if a.IsWindowMode != nil {
+			cfg.IsWindowMode = a.IsWindowMode
+		}
+		if a.Resize != nil {
+			cfg.Resize = *a.Resize
+		}
+		if a.HasChat != nil {
+			cfg.HasChat = *a.HasChat
+		}
+		if a.VideoCodec != "" {
+			cfg.VideoCodec = a.VideoCodec
+		}
+		if a.Launcher != nil {
+			cfg.Launcher = *a.Launcher
+			if cfg.Launcher.Type == "" {
+				cfg.Launcher.Type = c.Launcher.Type
+			}
+			if cfg.Launcher.Image == "" {
+				cfg.Launcher.Image = c.Launcher.Image
+			}
+		}
+		if a.OnDemand != nil {
+			cfg.OnDemand = *a.OnDemand
+		}
+		apps = append(apps, App{ID: a.ID, Config: cfg})
+	}
+	return apps
+}
+
+// ReadConfig reads the config file with environment variable overrides. See Load.
 func ReadConfig(path string) (Config, error) {
+	return Load(path, nil)
+}
+
+// Load reads the config file, then overrides it with CLOUDMORPH_* environment
+// variables and the flag overrides, applies defaults and validates the result.
+// Unknown keys and invalid values are reported together in a *ValidationError.
+func Load(path string, flagOverrides map[string]string) (Config, error) {
 	cfgyml, err := ioutil.ReadFile(path)
 	if err != nil {
 		return Config{}, err
 	}
 
 	cfg := Config{}
-	err = yaml.Unmarshal(cfgyml, &cfg)
+	var problems []string
+	if err := yaml.UnmarshalStrict(cfgyml, &cfg); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			// syntax error, nothing is decoded
+			return Config{}, fmt.Errorf("%s: %v", path, err)
+		}
+		problems = append(problems, typeErr.Errors...)
+	}
+	problems = append(problems, applyEnv(&cfg)...)
+	problems = append(problems, applyFlags(&cfg, flagOverrides)...)
+
+	setDefaults(&cfg)
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+	}
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
 
+func setDefaults(cfg *Config) {
 	if cfg.AppName == "" {
 		cfg.AppName = cfg.WindowTitle
 	}
+	if cfg.AppMode == "" {
+		cfg.AppMode = "collaborative"
+	}
+	if cfg.VideoCodec == "" {
+		cfg.VideoCodec = "h264"
+	}
 	if cfg.ScreenWidth == 0 {
 		cfg.ScreenWidth = 800
 	}
@@ -70,11 +353,94 @@ func ReadConfig(path string) (Config, error) {
 		boolTrue := true
 		cfg.IsWindowMode = &boolTrue
 	}
+	if cfg.Launcher.Type == "" {
+		cfg.Launcher.Type = "script"
+	}
+	if cfg.Launcher.Image == "" {
+		cfg.Launcher.Image = "syncwine"
+	}
+	if cfg.Sandbox.OverlayDir == "" {
+		cfg.Sandbox.OverlayDir = "overlay"
+	}
+	if cfg.Idle.Action == "" {
+		cfg.Idle.Action = "notify"
+	}
+	if cfg.ReconnectGrace == 0 {
+		cfg.ReconnectGrace = 30
+	}
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info"
+	}
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = LogFormatText
+	}
+	setResizeDefaults(&cfg.Resize)
+	setOnDemandDefaults(&cfg.OnDemand)
+	for _, app := range cfg.Apps {
+		if app.Resize != nil {
+			setResizeDefaults(app.Resize)
+		}
+		if app.OnDemand != nil {
+			setOnDemandDefaults(app.OnDemand)
+		}
+	}
+	for i := range cfg.ICEServers {
+		if cfg.ICEServers[i].Secret != "" && cfg.ICEServers[i].TTL == 0 {
+			cfg.ICEServers[i].TTL = 86400
+		}
+	}
+	if cfg.TURN.Enabled {
+		setTURNDefaults(&cfg.TURN)
+	}
+	if cfg.Auth.TokenTTL == 0 {
+		cfg.Auth.TokenTTL = 3600
+	}
 	if cfg.InstanceAddr == "" {
 		ip, _ := getLocalIP()
 		cfg.InstanceAddr = fmt.Sprintf("%s:%s", ip.String(), "8080")
 	}
-	return cfg, err
+}
+
+func setResizeDefaults(c *ResizeConfig) {
+	if !c.Enabled() {
+		return
+	}
+	if c.MinWidth == 0 {
+		c.MinWidth = 320
+	}
+	if c.MinHeight == 0 {
+		c.MinHeight = 240
+	}
+}
+
+func setTURNDefaults(c *TURNConfig) {
+	if c.Port == 0 {
+		c.Port = 3478
+	}
+	if c.Realm == "" {
+		c.Realm = "cloudmorph"
+	}
+	if c.MinRelayPort == 0 {
+		c.MinRelayPort = 49160
+	}
+	if c.MaxRelayPort == 0 {
+		c.MaxRelayPort = 49200
+	}
+	if c.TTL == 0 {
+		c.TTL = 600
+	}
+}
+
+func setOnDemandDefaults(c *OnDemandConfig) {
+	if c.PrewarmInstances == 0 {
+		c.PrewarmInstances = 1
+	}
+	if c.MaxInstances == 0 {
+		c.MaxInstances = 4
+	}
+	if c.GracePeriod == 0 {
+		c.GracePeriod = 60
+	}
 }
 
 func getLocalIP() (net.IP, error) {
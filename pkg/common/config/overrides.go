@@ -0,0 +1,211 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix prefixes the environment variables overriding the config,
+// ex. CLOUDMORPH_SCREEN_WIDTH=1024 or CLOUDMORPH_IDLE_INPUT_TIMEOUT=600
+const EnvPrefix = "CLOUDMORPH_"
+
+// DefaultPath is the config file read when no -config flag is given
+const DefaultPath = "config.yaml"
+
+// field is a config field with its yaml path, ex. [idle inputTimeout]
+type field struct {
+	path  []string
+	value reflect.Value
+}
+
+// key returns the flag name of the field, ex. idle.inputTimeout
+func (f field) key() string {
+	return strings.Join(f.path, ".")
+}
+
+// envName returns the environment variable of the field, ex. CLOUDMORPH_IDLE_INPUT_TIMEOUT
+func (f field) envName() string {
+	parts := make([]string, len(f.path))
+	for i, p := range f.path {
+		parts[i] = toScreamingSnake(p)
+	}
+	return EnvPrefix + strings.Join(parts, "_")
+}
+
+// fields returns the leaf fields of the struct v
+func fields(v reflect.Value, prefix []string) []field {
+	var out []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := append(append([]string{}, prefix...), name)
+		fv := v.Field(i)
+		switch {
+		case fv.Kind() == reflect.Struct:
+			out = append(out, fields(fv, path)...)
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.String:
+			// lists of structs, ex. the app catalog, are only set in the file
+		default:
+			out = append(out, field{path: path, value: fv})
+		}
+	}
+	return out
+}
+
+// setField parses s into the field. Lists are comma separated, maps are k=v,k=v.
+func setField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := setField(elem.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range splitList(s) {
+			list = reflect.Append(list, reflect.ValueOf(item))
+		}
+		v.Set(list)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, item := range splitList(s) {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q is not key=value", item)
+			}
+			m.SetMapIndex(reflect.ValueOf(kv[0]), reflect.ValueOf(kv[1]))
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// applyEnv overrides the config with CLOUDMORPH_* environment variables
+func applyEnv(cfg *Config) []string {
+	overrides := map[string]string{}
+	for _, f := range fields(reflect.ValueOf(cfg).Elem(), nil) {
+		if value, ok := os.LookupEnv(f.envName()); ok {
+			overrides[f.key()] = value
+		}
+	}
+	return applyOverrides(cfg, overrides, func(f field) string { return "env " + f.envName() })
+}
+
+// applyFlags overrides the config with the fields set on the command line
+func applyFlags(cfg *Config, overrides map[string]string) []string {
+	return applyOverrides(cfg, overrides, func(f field) string { return "flag -" + f.key() })
+}
+
+// applyOverrides sets the fields by key, ex. idle.inputTimeout. It returns a problem per invalid value.
+func applyOverrides(cfg *Config, overrides map[string]string, source func(field) string) []string {
+	var problems []string
+	for _, f := range fields(reflect.ValueOf(cfg).Elem(), nil) {
+		value, ok := overrides[f.key()]
+		if !ok {
+			continue
+		}
+		if err := setField(f.value, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", source(f), err))
+		}
+	}
+	return problems
+}
+
+// ParseFlags parses -config and a flag per config field, ex. -screenWidth 1024 or -idle.action=restart.
+// It returns the config path and the fields set on the command line.
+func ParseFlags(name string, args []string, output io.Writer) (string, map[string]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	path := fs.String("config", DefaultPath, "path of the config file")
+
+	overrides := map[string]string{}
+	for _, f := range fields(reflect.ValueOf(&Config{}).Elem(), nil) {
+		fs.Var(&overrideFlag{
+			key:       f.key(),
+			overrides: overrides,
+			isBool:    f.value.Kind() == reflect.Bool,
+		}, f.key(), "overrides "+f.key()+", env "+f.envName())
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", nil, err
+	}
+	return *path, overrides, nil
+}
+
+// overrideFlag records the flag value to apply on top of the config file
+type overrideFlag struct {
+	key       string
+	overrides map[string]string
+	isBool    bool
+}
+
+func (f *overrideFlag) String() string {
+	if f == nil || f.overrides == nil {
+		return ""
+	}
+	return f.overrides[f.key]
+}
+
+func (f *overrideFlag) Set(s string) error {
+	f.overrides[f.key] = s
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// toScreamingSnake converts a yaml key to an environment variable part, ex. inputTimeout to INPUT_TIMEOUT
+func toScreamingSnake(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
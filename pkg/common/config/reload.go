@@ -0,0 +1,97 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reloadInterval is how often the config file is checked for changes
+const reloadInterval = 2 * time.Second
+
+// Diff returns the yaml keys of the top level fields that differ
+func Diff(a Config, b Config) []string {
+	var keys []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			keys = append(keys, strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0])
+		}
+	}
+	return keys
+}
+
+// Watcher reloads the config file when it changes or the process gets SIGHUP
+type Watcher struct {
+	path string
+	// overrides are the flags applied on every reload
+	overrides map[string]string
+	modTime   time.Time
+	updates   chan Config
+	hup       chan os.Signal
+	done      chan struct{}
+}
+
+// NewWatcher watches the config file at path. The flag overrides are layered on top, see Load.
+func NewWatcher(path string, overrides map[string]string) *Watcher {
+	w := &Watcher{
+		path:      path,
+		overrides: overrides,
+		updates:   make(chan Config, 1),
+		hup:       make(chan os.Signal, 1),
+		done:      make(chan struct{}),
+	}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	signal.Notify(w.hup, syscall.SIGHUP)
+	go w.watch()
+	return w
+}
+
+// Updates returns the valid configs read on every change
+func (w *Watcher) Updates() <-chan Config {
+	return w.updates
+}
+
+// Close stops watching
+func (w *Watcher) Close() {
+	signal.Stop(w.hup)
+	close(w.done)
+}
+
+func (w *Watcher) watch() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.hup:
+			slog.Info("Received SIGHUP, reloading the config", "path", w.path)
+		case <-ticker.C:
+			info, err := os.Stat(w.path)
+			if err != nil || info.ModTime().Equal(w.modTime) {
+				continue
+			}
+			w.modTime = info.ModTime()
+			slog.Info("Config file changed, reloading", "path", w.path)
+		}
+
+		cfg, err := Load(w.path, w.overrides)
+		if err != nil {
+			slog.Warn("Config is not reloaded", "path", w.path, "err", err)
+			continue
+		}
+		select {
+		case w.updates <- cfg:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	minScreenSize   = 64
+	maxScreenWidth  = 7680
+	maxScreenHeight = 4320
+	// maxSlots bounds the app instances of a server, each slot takes a port of every kind
+	maxSlots = 80
+)
+
+var appIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidationError lists all problems of a config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// ValidateCommand runs the validate subcommand: it loads the config with the
+// flags in args and prints every problem. It returns the exit code.
+func ValidateCommand(name string, args []string, out io.Writer) int {
+	path, overrides, err := ParseFlags(name+" validate", args, out)
+	if err != nil {
+		return 2
+	}
+	if _, err := Load(path, overrides); err != nil {
+		if v, ok := err.(*ValidationError); ok {
+			fmt.Fprintf(out, "%s has %d problems:\n", path, len(v.Problems))
+			for _, p := range v.Problems {
+				fmt.Fprintln(out, "  -", p)
+			}
+		} else {
+			fmt.Fprintln(out, err)
+		}
+		return 1
+	}
+	fmt.Fprintln(out, path, "is valid")
+	return 0
+}
+
+// Validate returns a *ValidationError listing every problem, or nil if the config can be run
+func (c Config) Validate() error {
+	v := validator{}
+	if len(c.Apps) == 0 {
+		v.app("", c)
+	} else {
+		ids := map[string]bool{}
+		for i, app := range c.Catalog() {
+			prefix := fmt.Sprintf("apps[%d].", i)
+			if !appIDPattern.MatchString(app.ID) {
+				v.problem("%sid: %q must be letters, digits, - or _", prefix, app.ID)
+			} else if ids[app.ID] {
+				v.problem("%sid: %q is used by another app", prefix, app.ID)
+			}
+			ids[app.ID] = true
+			v.app(prefix, app.Config)
+		}
+	}
+
+	slots := 0
+	for _, app := range c.Catalog() {
+		slots += app.Config.NumSlots()
+	}
+	if slots > maxSlots {
+		v.problem("apps: %d app instances are more than %d", slots, maxSlots)
+	}
+
+	v.notNegative("maxClients", c.MaxClients)
+	v.notNegative("maxPlayers", c.MaxPlayers)
+	v.notNegative("inputRateLimit", c.InputRateLimit)
+	v.oneOf("idle.action", c.Idle.Action, "notify", "restart", "shutdown")
+	v.notNegative("idle.inputTimeout", c.Idle.InputTimeout)
+	v.notNegative("idle.emptyTimeout", c.Idle.EmptyTimeout)
+	v.notNegative("sandbox.memoryMB", int(c.Sandbox.MemoryMB))
+	v.notNegative("sandbox.pidsLimit", int(c.Sandbox.PidsLimit))
+	if c.Sandbox.CPUs < 0 {
+		v.problem("sandbox.cpus: %v cannot be negative", c.Sandbox.CPUs)
+	}
+	if c.Sandbox.Network == "host" {
+		v.problem("sandbox.network: leave it empty for the host network")
+	}
+	if c.StunTurn != "" && len(c.ICEServers) > 0 {
+		v.problem("stunturn: use either stunturn or iceServers")
+	}
+	for i, server := range c.ICEServers {
+		v.iceServer(fmt.Sprintf("iceServers[%d].", i), server)
+	}
+	if t := c.TURN; t.Enabled {
+		v.inRange("turn.port", t.Port, 1, 65535)
+		v.inRange("turn.minRelayPort", t.MinRelayPort, 1, 65535)
+		v.inRange("turn.maxRelayPort", t.MaxRelayPort, t.MinRelayPort, 65535)
+		v.inRange("turn.ttl", t.TTL, 1, 86400)
+		if t.PublicIP != "" && net.ParseIP(t.PublicIP) == nil {
+			v.problem("turn.publicIP: %q is not an IP", t.PublicIP)
+		}
+	}
+	v.notNegative("auth.tokenTTL", c.Auth.TokenTTL)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		v.problem("log.level: %q must be debug, info, warn or error", c.Log.Level)
+	}
+	v.oneOf("log.format", c.Log.Format, LogFormatText, LogFormatJSON)
+	if c.MaxClients > 0 && c.MaxPlayers > c.MaxClients {
+		v.problem("maxPlayers: %d is more than maxClients %d", c.MaxPlayers, c.MaxClients)
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// app checks the fields describing an app, keys are prefixed in the catalog
+func (v *validator) app(prefix string, c Config) {
+	v.required(prefix+"path", c.Path)
+	v.required(prefix+"appFile", c.AppFile)
+	v.required(prefix+"windowTitle", c.WindowTitle)
+	v.oneOf(prefix+"appMode", c.AppMode, "collaborative", "ondemand")
+	v.oneOf(prefix+"videoCodec", c.VideoCodec, "h264", "vpx")
+	v.oneOf(prefix+"launcher.type", c.Launcher.Type, "script", "process", "docker")
+	v.inRange(prefix+"screenWidth", c.ScreenWidth, minScreenSize, maxScreenWidth)
+	v.inRange(prefix+"screenHeight", c.ScreenHeight, minScreenSize, maxScreenHeight)
+	if r := c.Resize; r.Enabled() {
+		v.inRange(prefix+"resize.maxWidth", r.MaxWidth, minScreenSize, maxScreenWidth)
+		v.inRange(prefix+"resize.maxHeight", r.MaxHeight, minScreenSize, maxScreenHeight)
+		v.inRange(prefix+"resize.minWidth", r.MinWidth, minScreenSize, r.MaxWidth)
+		v.inRange(prefix+"resize.minHeight", r.MinHeight, minScreenSize, r.MaxHeight)
+		v.inRange(prefix+"screenWidth", c.ScreenWidth, r.MinWidth, r.MaxWidth)
+		v.inRange(prefix+"screenHeight", c.ScreenHeight, r.MinHeight, r.MaxHeight)
+	}
+	if c.AppMode == "ondemand" {
+		v.inRange(prefix+"onDemand.maxInstances", c.OnDemand.MaxInstances, 1, maxSlots)
+		v.inRange(prefix+"onDemand.prewarmInstances", c.OnDemand.PrewarmInstances, 0, c.OnDemand.MaxInstances)
+		v.notNegative(prefix+"onDemand.gracePeriod", c.OnDemand.GracePeriod)
+	}
+}
+
+// iceServer checks the URLs and the credentials of a STUN/TURN server
+func (v *validator) iceServer(prefix string, s ICEServerConfig) {
+	if len(s.URLs) == 0 {
+		v.problem("%surls: is required", prefix)
+	}
+	isTURN := false
+	for _, u := range s.URLs {
+		scheme := strings.SplitN(u, ":", 2)[0]
+		switch scheme {
+		case "turn", "turns":
+			isTURN = true
+		case "stun", "stuns":
+		default:
+			v.problem("%surls: %q is not a stun:, stuns:, turn: or turns: URL", prefix, u)
+		}
+	}
+	if s.Secret != "" && (s.Username != "" || s.Credential != "") {
+		v.problem("%ssecret: use either secret or username and credential", prefix)
+	}
+	if isTURN && s.Secret == "" && (s.Username == "" || s.Credential == "") {
+		v.problem("%scredential: TURN needs username and credential, or secret", prefix)
+	}
+	v.notNegative(prefix+"ttl", s.TTL)
+}
+
+// NumSlots returns the number of app instances the app may run
+func (c Config) NumSlots() int {
+	if c.AppMode == "ondemand" {
+		return c.OnDemand.MaxInstances
+	}
+	return 1
+}
+
+// validator collects problems
+type validator struct {
+	problems []string
+}
+
+func (v *validator) problem(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) required(key string, value string) {
+	if value == "" {
+		v.problem("%s: is required", key)
+	}
+}
+
+func (v *validator) oneOf(key string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.problem("%s: %q is not one of %s", key, value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) inRange(key string, value int, min int, max int) {
+	if value < min || value > max {
+		v.problem("%s: %d is not between %d and %d", key, value, min, max)
+	}
+}
+
+func (v *validator) notNegative(key string, value int) {
+	if value < 0 {
+		v.problem("%s: %d cannot be negative", key, value)
+	}
+}
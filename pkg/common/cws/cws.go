@@ -2,10 +2,13 @@ package cws
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -21,6 +24,8 @@ type Client struct {
 	sendCallbackLock sync.Mutex
 	// recvCallback is callback when receive based on ID of the packet
 	recvCallback map[string]func(req WSPacket)
+	// logger holds the *slog.Logger of the client, see SetLogger
+	logger atomic.Value
 
 	Done chan struct{}
 }
@@ -45,7 +50,7 @@ func NewClient(conn *websocket.Conn) *Client {
 	sendCallback := map[string]func(WSPacket){}
 	recvCallback := map[string]func(WSPacket){}
 
-	return &Client{
+	c := &Client{
 		id:   id,
 		conn: conn,
 
@@ -54,6 +59,18 @@ func NewClient(conn *websocket.Conn) *Client {
 
 		Done: make(chan struct{}),
 	}
+	c.SetLogger(slog.Default())
+	return c
+}
+
+// SetLogger sets the logger with the context of the client owning the websocket, ex. its session
+func (c *Client) SetLogger(logger *slog.Logger) {
+	c.logger.Store(logger.With(logging.KeyWS, c.id))
+}
+
+// Logger returns the logger of the websocket
+func (c *Client) Logger() *slog.Logger {
+	return c.logger.Load().(*slog.Logger)
 }
 
 // Send sends a packet and trigger callback when the packet comes back
@@ -69,7 +86,7 @@ func (c *Client) Send(request WSPacket, callback func(response WSPacket)) {
 		wrapperCallback := func(resp WSPacket) {
 			defer func() {
 				if err := recover(); err != nil {
-					log.Println("Recovered from err in client callback ", err)
+					c.Logger().Error("Recovered from a panic in the callback", "type", request.Type, "err", err)
 				}
 			}()
 
@@ -109,7 +126,7 @@ func (c *Client) Receive(id string, f func(request WSPacket) (response WSPacket)
 		}
 		respText, err := json.Marshal(resp)
 		if err != nil {
-			log.Println("[!] json marshal error:", err)
+			c.Logger().Error("Cannot encode the response", "type", resp.Type, "err", err)
 		}
 		c.sendLock.Lock()
 		c.conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
@@ -153,7 +170,7 @@ func (c *Client) Heartbeat() {
 	for range timer {
 		select {
 		case <-c.Done:
-			log.Println("Close heartbeat")
+			c.Logger().Debug("Close heartbeat")
 			return
 		default:
 		}
@@ -163,11 +180,13 @@ func (c *Client) Heartbeat() {
 
 // Listen start a client
 func (c *Client) Listen() {
+	metrics.WSClients.Inc()
+	defer metrics.WSClients.Dec()
 	for {
 		c.conn.SetReadDeadline(time.Now().Add(20 * time.Second))
 		_, rawMsg, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Println("[!] read:", err)
+			c.Logger().Info("Websocket closed", "err", err)
 			// TODO: Check explicit disconnect error to break
 			close(c.Done)
 			break
@@ -176,7 +195,7 @@ func (c *Client) Listen() {
 		err = json.Unmarshal(rawMsg, &wspacket)
 
 		if err != nil {
-			log.Println("Warn: error decoding", rawMsg)
+			c.Logger().Warn("Cannot decode the packet", "err", err, "size", len(rawMsg))
 			continue
 		}
 
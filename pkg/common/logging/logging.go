@@ -0,0 +1,40 @@
+// Package logging sets up the structured logger of the process
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// Context keys of the loggers, shared so the lines of a session can be grepped
+const (
+	KeyApp      = "app"
+	KeyInstance = "instance"
+	KeyClient   = "client"
+	KeySession  = "session"
+	KeyPeer     = "peer"
+	KeyWS       = "ws"
+)
+
+// Setup makes the logger of the config the default one. The lines of the log
+// package go through it at info level.
+func Setup(cfg config.LogConfig) {
+	slog.SetDefault(New(cfg, os.Stderr))
+}
+
+// New returns the logger of the config writing to out
+func New(cfg config.LogConfig, out io.Writer) *slog.Logger {
+	level := slog.LevelInfo
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		// the config is validated, keep the default
+		slog.Warn("Invalid log level, using info", "level", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(out, opts))
+	}
+	return slog.New(slog.NewTextHandler(out, opts))
+}
@@ -0,0 +1,110 @@
+// Package metrics are the Prometheus metrics of the server, served on the monitoring port
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cloudmorph"
+
+// Streams of the RTP metrics
+const (
+	StreamVideo = "video"
+	StreamAudio = "audio"
+)
+
+var (
+	// WSClients is the number of connected websockets, the app and the chat ones
+	WSClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_clients",
+		Help:      "Number of connected websocket clients.",
+	})
+
+	// ActivePeers is the number of WebRTC peers not stopped yet
+	ActivePeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "webrtc_active_peers",
+		Help:      "Number of WebRTC peer connections not closed yet.",
+	})
+
+	// RTPPacketsIn is the RTP read from the app, by stream
+	RTPPacketsIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_in_total",
+		Help:      "RTP packets read from the app.",
+	}, []string{"stream"})
+
+	// RTPPacketsOut is the RTP written to the peers, by stream
+	RTPPacketsOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_out_total",
+		Help:      "RTP packets written to the peers.",
+	}, []string{"stream"})
+
+	// RTPPacketsDropped is the RTP of a client not written to its peer, by stream
+	RTPPacketsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_dropped_total",
+		Help:      "RTP packets of a client dropped while it has no peer streaming.",
+	}, []string{"stream"})
+
+	// FramesSent is the video frames written to the peers
+	FramesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "video_frames_sent_total",
+		Help:      "Video frames written to the peers.",
+	})
+
+	// RTCPFeedback is the NACKed packets and the key frame requests of the peers, by type nack or pli
+	RTCPFeedback = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtcp_feedback_total",
+		Help:      "Packets NACKed and key frames requested by the peers.",
+	}, []string{"type"})
+
+	// PeerRTT is the round trip of the peers, sampled with their stats
+	PeerRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webrtc_rtt_seconds",
+		Help:      "Round trip time of the peers.",
+		Buckets:   []float64{.01, .025, .05, .075, .1, .15, .2, .3, .5, 1},
+	})
+
+	// InputEvents is the input sent to the app, by type
+	InputEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "input_events_total",
+		Help:      "Input events sent to the app.",
+	}, []string{"type"})
+
+	// AppRestarts is the restarts of the app processes, by app
+	AppRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "app_restarts_total",
+		Help:      "Restarts of the app processes.",
+	}, []string{"app"})
+
+	// DiscoveryRegistered is 1 while the app is registered in discovery, by app
+	DiscoveryRegistered = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "discovery_registered",
+		Help:      "Whether the app is registered in discovery.",
+	}, []string{"app"})
+
+	// ChatMessages is the messages broadcast by the text chat
+	ChatMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chat_messages_total",
+		Help:      "Chat messages broadcast.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,131 @@
+package cloudapp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+const (
+	// IdleActionNotify tells the clients the session is idle
+	IdleActionNotify = "notify"
+	// IdleActionRestart restarts the app to a fresh state
+	IdleActionRestart = "restart"
+	// IdleActionShutdown stops the app and the server
+	IdleActionShutdown = "shutdown"
+)
+
+const idleCheckInterval = 10 * time.Second
+
+// activityTracker records the last input and when the session became empty
+type activityTracker struct {
+	lock         sync.Mutex
+	numClients   int
+	lastActivity time.Time
+	emptySince   time.Time
+}
+
+func newActivityTracker() *activityTracker {
+	now := time.Now()
+	return &activityTracker{
+		lastActivity: now,
+		emptySince:   now,
+	}
+}
+
+// Input records an input event from a client
+func (a *activityTracker) Input() {
+	a.lock.Lock()
+	a.lastActivity = time.Now()
+	a.lock.Unlock()
+}
+
+// Join records a client joining the session
+func (a *activityTracker) Join() {
+	a.lock.Lock()
+	a.numClients++
+	a.lastActivity = time.Now()
+	a.lock.Unlock()
+}
+
+// Leave records a client leaving the session
+func (a *activityTracker) Leave() {
+	a.lock.Lock()
+	a.numClients--
+	a.lastActivity = time.Now()
+	if a.numClients == 0 {
+		a.emptySince = a.lastActivity
+	}
+	a.lock.Unlock()
+}
+
+// idleReason returns why the session is idle, or "" if it is active.
+// The idle period restarts after it is reported.
+func (a *activityTracker) idleReason(cfg config.IdleConfig) string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	reason := ""
+	if cfg.EmptyTimeout > 0 && a.numClients == 0 && now.Sub(a.emptySince) >= time.Duration(cfg.EmptyTimeout)*time.Second {
+		reason = "empty"
+	} else if cfg.InputTimeout > 0 && now.Sub(a.lastActivity) >= time.Duration(cfg.InputTimeout)*time.Second {
+		reason = "noinput"
+	}
+	if reason != "" {
+		a.lastActivity = now
+		a.emptySince = now
+	}
+	return reason
+}
+
+// watchIdle runs the configured action whenever the session is idle
+func (s *Service) watchIdle() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		// idle settings can change on reload
+		cfg := s.getConfig().Idle
+		reason := s.activity.idleReason(cfg)
+		if reason == "" {
+			continue
+		}
+		s.log.Info("Session is idle", "reason", reason, "action", cfg.Action)
+		s.broadcast(cws.WSPacket{Type: "IDLE", Data: reason})
+
+		switch cfg.Action {
+		case IdleActionRestart:
+			s.restartApp()
+		case IdleActionShutdown:
+			s.Shutdown()
+			return
+		}
+	}
+}
+
+func (s *Service) restartApp() {
+	app, ok := s.ccApp.(*ccImpl)
+	if !ok {
+		// ondemand instances are torn down when their user leaves
+		s.log.Warn("Restart is only supported for a shared app")
+		return
+	}
+	app.Restart()
+}
+
+// broadcast sends the packet to all admitted clients
+func (s *Service) broadcast(packet cws.WSPacket) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	for _, client := range s.clients {
+		client.send(packet)
+	}
+}
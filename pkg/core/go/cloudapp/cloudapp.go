@@ -2,20 +2,22 @@
 package cloudapp
 
 import (
-	"bufio"
 	"container/ring"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/giongto35/cloud-morph/pkg/common/config"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 	"github.com/pion/rtp"
 )
 
@@ -36,84 +38,170 @@ const (
 
 type ccImpl struct {
 	isReady       bool
+	ports         appPorts
 	videoListener *net.UDPConn
 	audioListener *net.UDPConn
+	inputListener *net.TCPListener
 	videoStream   chan *rtp.Packet
 	audioStream   chan *rtp.Packet
 	appEvents     chan Packet
 	wineConn      *net.TCPConn
 	osType        osTypeEnum
-	screenWidth   float32
-	screenHeight  float32
 	ssrc          uint32
+	lifecycle     *appLifecycle
+	// launcher and spec of the next launch, replaced by Reconfigure
+	launchLock sync.Mutex
+	launcher   Launcher
+	spec       LaunchSpec
+	// screen size of the app and its bounds, guarded by launchLock
+	screenWidth  float32
+	screenHeight float32
+	resize       config.ResizeConfig
+	// resizeLock serializes the resizes of the display
+	resizeLock sync.Mutex
+	// onResize is called once the screen is resized
+	onResize func(width, height int)
+	// done to stop all goroutines of the app
+	done chan struct{}
+	log  *slog.Logger
 }
 
 // Packet represents a packet in cloudapp
 type Packet struct {
 	Type string `json:"type"`
 	Data string `json:"data"`
+	// received is when the input reached the server, onDispatch is told how long
+	// it took to reach the app. Both are optional.
+	received   time.Time
+	onDispatch func(time.Duration)
+}
+
+// dispatched reports the input has reached the app
+func (p Packet) dispatched() {
+	if p.onDispatch != nil && !p.received.IsZero() {
+		p.onDispatch(time.Since(p.received))
+	}
+}
+
+// appPorts are the local ports an app instance streams to and receives input from
+type appPorts struct {
+	container  string
+	video      int
+	audio      int
+	input      int
+	supervisor int
 }
 
 const startVideoRTPPort = 5004
 const startAudioRTPPort = 4004
+const startInputPort = 9090
+const startSupervisorPort = 9001
+const defaultContainerName = "appvm"
 const eventKeyDown = "KEYDOWN"
 const eventKeyUp = "KEYUP"
 const eventMouseMove = "MOUSEMOVE"
 const eventMouseDown = "MOUSEDOWN"
 const eventMouseUp = "MOUSEUP"
+const eventResize = "RESIZE"
+
+// displayScript manages the virtual display and its stream in the app VM
+const displayScript = "/winvm/display.sh"
 
-var curVideoRTPPort = startVideoRTPPort
-var curAudioRTPPort = startAudioRTPPort
+// newAppPorts returns ports of the app instance in the slot. Slot 0 is the default single app.
+func newAppPorts(slot int) appPorts {
+	container := defaultContainerName
+	if slot > 0 {
+		container = fmt.Sprintf("%s%d", defaultContainerName, slot)
+	}
+	return appPorts{
+		container:  container,
+		video:      startVideoRTPPort + slot,
+		audio:      startAudioRTPPort + slot,
+		input:      startInputPort + slot,
+		supervisor: startSupervisorPort + slot,
+	}
+}
 
 // NewCloudAppClient returns new cloudapp client
 func NewCloudAppClient(cfg config.Config, appEvents chan Packet) *ccImpl {
+	c, err := newCloudAppClient(cfg, appEvents, newAppPorts(0), nil, slog.Default(), nil)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// newCloudAppClient launches an app instance on the given ports and waits for its streams.
+// The instance logs with the context of logger. The launch fails once abort is closed.
+func newCloudAppClient(cfg config.Config, appEvents chan Packet, ports appPorts, onStateChange func(AppStatus), logger *slog.Logger, abort <-chan struct{}) (*ccImpl, error) {
 	c := &ccImpl{
+		ports:       ports,
 		videoStream: make(chan *rtp.Packet, 1),
 		audioStream: make(chan *rtp.Packet, 1),
 		appEvents:   appEvents,
+		done:        make(chan struct{}),
+		log:         logger.With(logging.KeyInstance, ports.container),
 	}
 
 	switch runtime.GOOS {
 	case "windows":
 		c.osType = Windows
+	case "darwin":
+		c.osType = Mac
 	default:
 		c.osType = Linux
 	}
 
-	la, err := net.ResolveTCPAddr("tcp4", ":9090")
+	la, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", ports.input))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	log.Println("listening syncinput at port 9090")
+	c.log.Info("Listening to syncinput", "port", ports.input)
 	ln, err := net.ListenTCP("tcp", la)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	c.inputListener = ln
 
-	fmt.Println(cfg)
-	c.launchAppVM(curVideoRTPPort, curAudioRTPPort, cfg)
-	log.Println("Launched application VM")
+	c.log.Debug("Launching the app", "config", cfg)
+	c.lifecycle, err = c.newAppVMLifecycle(cfg)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	c.lifecycle.onStateChange = onStateChange
+	c.lifecycle.Start()
+	c.log.Info("Launched the app VM")
 
 	// Read video stream from encoded video stream produced by FFMPEG
-	log.Println("Setup Video Listener")
-	videoListener, listenerssrc := c.newLocalStreamListener(curVideoRTPPort)
+	c.log.Debug("Waiting for the video stream", "port", ports.video)
+	videoListener, listenerssrc, err := c.newLocalStreamListener(ports.video, abort)
+	if err != nil {
+		c.lifecycle.Stop()
+		ln.Close()
+		return nil, err
+	}
 	c.videoListener = videoListener
 	c.ssrc = listenerssrc
 	if c.osType != Windows {
 		// Don't spawn Audio in Windows
-		log.Println("Setup Audio Listener")
-		audioListener, audiolistenerssrc := c.newLocalStreamListener(curAudioRTPPort)
+		c.log.Debug("Waiting for the audio stream", "port", ports.audio)
+		audioListener, audiolistenerssrc, err := c.newLocalStreamListener(ports.audio, abort)
+		if err != nil {
+			c.lifecycle.Stop()
+			ln.Close()
+			videoListener.Close()
+			return nil, err
+		}
 		c.audioListener = audioListener
 		c.ssrc = audiolistenerssrc
 	}
-	log.Println("Done Listener")
+	c.log.Debug("Received the streams")
 
 	c.listenVideoStream()
-	log.Println("Launched Video stream listener")
 	if c.osType != Windows {
 		// Don't spawn Audio in Windows
 		c.listenAudioStream()
-		log.Println("Launched Audio stream listener")
 	}
 
 	// Maintain input stream from server to Virtual Machine over websocket
@@ -121,22 +209,25 @@ func NewCloudAppClient(cfg config.Config, appEvents chan Packet) *ccImpl {
 	// NOTE: Why Websocket: because normal IPC cannot communicate cross OS.
 	go func() {
 		for {
-			log.Println("Waiting syncinput to connect")
+			c.log.Debug("Waiting for syncinput to connect")
 			// Polling Wine socket connection (input stream)
 			conn, err := ln.AcceptTCP()
-			log.Println("Accepted a TCP connection")
 			if err != nil {
-				log.Println("err: ", err)
+				if c.isClosed() {
+					return
+				}
+				c.log.Warn("Cannot accept syncinput", "err", err)
+				continue
 			}
 			conn.SetKeepAlive(true)
 			conn.SetKeepAlivePeriod(10 * time.Second)
 			c.wineConn = conn
 			c.isReady = true
-			log.Println("Launched IPC with VM")
+			c.log.Info("Syncinput connected", "addr", conn.RemoteAddr().String())
 		}
 	}()
 
-	return c
+	return c, nil
 }
 
 // convertWSPacket returns cloudapp packet from ws packet
@@ -151,150 +242,387 @@ func (c *ccImpl) GetSSRC() uint32 {
 	return c.ssrc
 }
 
-func (c *ccImpl) runApp(execCmd string, params []string) chan struct{} {
-	log.Println("params: ", params)
+func (c *ccImpl) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Restart relaunches the app on the same ports. Streams resume when the new app is up.
+func (c *ccImpl) Restart() {
+	c.log.Info("Restarting the app")
+	c.isReady = false
+	c.lifecycle.Restart()
+}
+
+// Status returns the lifecycle state of the app
+func (c *ccImpl) Status() AppStatus {
+	return c.lifecycle.Status()
+}
+
+// Close stops the app instance and releases its ports
+func (c *ccImpl) Close() {
+	if c.isClosed() {
+		return
+	}
+	close(c.done)
+	c.isReady = false
+	c.lifecycle.Stop()
+	c.inputListener.Close()
+	if c.wineConn != nil {
+		c.wineConn.Close()
+	}
+	c.videoListener.Close()
+	if c.audioListener != nil {
+		c.audioListener.Close()
+	}
+	c.log.Info("Closed the app instance")
+}
 
-	var cmd *exec.Cmd
-	cmd = exec.Command(execCmd, params...)
+// Reconfigure relaunches the app with the app fields of cfg, on the same ports
+func (c *ccImpl) Reconfigure(cfg config.Config) error {
+	launcher, spec, err := c.prepareLaunch(cfg)
+	if err != nil {
+		return err
+	}
+	c.setLaunch(launcher, spec, cfg)
+	c.lifecycle.SetDetached(isDetached(launcher))
+	c.Restart()
+	return nil
+}
 
-	cmd.Env = os.Environ()
-	stdout, err := cmd.StdoutPipe()
+// newAppVMLifecycle returns the lifecycle of the app VM started by the configured launcher
+func (c *ccImpl) newAppVMLifecycle(cfg config.Config) (*appLifecycle, error) {
+	launcher, spec, err := c.prepareLaunch(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			log.Printf(scanner.Text())
-		}
-	}()
-	stderr, err := cmd.StderrPipe()
+	c.setLaunch(launcher, spec, cfg)
+
+	launch := func() (Process, error) {
+		c.launchLock.Lock()
+		launcher, spec := c.launcher, c.spec
+		c.launchLock.Unlock()
+		return launcher.Launch(spec)
+	}
+	return newAppLifecycle(spec.Name, launch, isDetached(launcher), c.log), nil
+}
+
+// prepareLaunch returns the configured launcher and the spec of the app VM
+func (c *ccImpl) prepareLaunch(cfg config.Config) (Launcher, LaunchSpec, error) {
+	launcher, err := NewLauncher(cfg, c.osType, c.log)
 	if err != nil {
-		log.Fatal(err)
+		return nil, LaunchSpec{}, err
 	}
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Printf(scanner.Text())
+	gateway := ""
+	if cfg.Sandbox.Network != "" {
+		p, ok := launcher.(networkPreparer)
+		if !ok {
+			return nil, LaunchSpec{}, fmt.Errorf("launcher %s doesn't support a sandbox network", cfg.Launcher.Type)
+		}
+		if gateway, err = p.PrepareNetwork(cfg.Sandbox.Network, cfg.Sandbox.Internal); err != nil {
+			return nil, LaunchSpec{}, err
 		}
-	}()
-	err = cmd.Start()
-	if err != nil {
-		log.Printf("err: cmd fail, %v", err)
-		return nil
 	}
-	log.Println("Done running script")
-	err = cmd.Wait()
+	spec, err := c.launchSpec(cfg, gateway)
 	if err != nil {
-		log.Printf("err: cmd fail, %v", err)
-		return nil
+		return nil, LaunchSpec{}, err
 	}
+	return launcher, spec, nil
+}
 
-	done := make(chan struct{})
-	// clean up func
-	go func() {
-		<-done
-		err := cmd.Process.Kill()
-		cmd.Process.Kill()
-		log.Println("Kill app: ", err)
-	}()
-	return done
+func (c *ccImpl) setLaunch(launcher Launcher, spec LaunchSpec, cfg config.Config) {
+	c.launchLock.Lock()
+	c.launcher = launcher
+	c.spec = spec
+	c.screenWidth = float32(cfg.ScreenWidth)
+	c.screenHeight = float32(cfg.ScreenHeight)
+	c.resize = cfg.Resize
+	c.launchLock.Unlock()
 }
 
-// done to forcefully stop all processes
-func (c *ccImpl) launchAppVM(curVideoRTPPort int, curAudioRTPPort int, cfg config.Config) chan struct{} {
-	var execCmd string
-	var params []string
+// screenSize returns the current screen size of the app
+func (c *ccImpl) screenSize() (float32, float32) {
+	c.launchLock.Lock()
+	defer c.launchLock.Unlock()
+	return c.screenWidth, c.screenHeight
+}
 
-	// Setup wine params and run
-	log.Println("execing run-wine.sh")
-	// TODO: refactor to key value
-	// Add Exec command based on platform
-	if c.osType == Windows {
-		log.Println("You are running on Windows")
-		execCmd = "powershell"
-		params = append(params, []string{"-ExecutionPolicy", "Bypass", "-F"}...)
-		if cfg.IsVirtualized {
-			params = append(params, "run-sandbox.ps1")
-		} else {
-			params = append(params, "run-app.ps1")
-		}
-	} else {
-		log.Println("You are running on Linux")
-		execCmd = "./run-wine.sh"
+// resizeBounds returns the sizes the app may be resized to
+func (c *ccImpl) resizeBounds() config.ResizeConfig {
+	c.launchLock.Lock()
+	defer c.launchLock.Unlock()
+	return c.resize
+}
+
+// Resize changes the virtual display and the stream of the app VM to width x height.
+// The size must be within the configured bounds, it is rounded down to even for the encoder.
+func (c *ccImpl) Resize(width, height int) error {
+	c.resizeLock.Lock()
+	defer c.resizeLock.Unlock()
+
+	c.launchLock.Lock()
+	bounds, launcher, name := c.resize, c.launcher, c.spec.Name
+	c.launchLock.Unlock()
+	if !bounds.Enabled() {
+		return fmt.Errorf("resize is disabled")
+	}
+	width, height = width&^1, height&^1
+	if width < bounds.MinWidth || width > bounds.MaxWidth || height < bounds.MinHeight || height > bounds.MaxHeight {
+		return fmt.Errorf("screen %dx%d is not between %dx%d and %dx%d", width, height,
+			bounds.MinWidth, bounds.MinHeight, bounds.MaxWidth, bounds.MaxHeight)
 	}
-	// Add params
+	runner, ok := launcher.(commandRunner)
+	if !ok {
+		return fmt.Errorf("the launcher cannot resize %s", name)
+	}
+	if err := runner.Exec(name, []string{displayScript, "resize", strconv.Itoa(width), strconv.Itoa(height)}); err != nil {
+		return err
+	}
+
+	c.launchLock.Lock()
+	c.screenWidth = float32(width)
+	c.screenHeight = float32(height)
+	// a restarted app keeps the size
+	env := make(map[string]string, len(c.spec.Env))
+	for k, v := range c.spec.Env {
+		env[k] = v
+	}
+	env["screenwidth"] = strconv.Itoa(width)
+	env["screenheight"] = strconv.Itoa(height)
+	c.spec.Env = env
+	c.launchLock.Unlock()
+	c.log.Info("Resized the app", "width", width, "height", height)
+
+	if c.onResize != nil {
+		c.onResize(width, height)
+	}
+	return nil
+}
+
+// resizeFromPayload resizes the app to the size requested by a client
+func (c *ccImpl) resizeFromPayload(jsonPayload string) {
+	type resizePayload struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	}
+	p := resizePayload{}
+	if err := json.Unmarshal([]byte(jsonPayload), &p); err != nil {
+		c.log.Warn("Invalid resize request", "err", err)
+		return
+	}
+	if err := c.Resize(p.Width, p.Height); err != nil {
+		c.log.Warn("Cannot resize the app", "err", err)
+	}
+}
+
+// isDetached returns true if the launched process returns once the app is spawned
+func isDetached(launcher Launcher) bool {
+	l, ok := launcher.(*scriptLauncher)
+	return ok && l.Detached()
+}
+
+// launchSpec describes the app VM of the instance. gateway is the host address in the sandbox network.
+func (c *ccImpl) launchSpec(cfg config.Config, gateway string) (LaunchSpec, error) {
+	appPath := "/" + cfg.Path // Path in docker container after mount is at root
 	if c.osType == Windows {
-		params = append(params, cfg.Path)
-	} else {
-		params = append(params, "/"+cfg.Path) // Path in docker container after mount is at root
+		appPath = cfg.Path
 	}
-	params = append(params, []string{cfg.AppFile, cfg.WindowTitle}...)
+	hwKey := "app"
 	if cfg.HWKey {
-		params = append(params, "game")
-	} else {
-		params = append(params, "app")
+		hwKey = "game"
 	}
-	params = append(params, []string{strconv.Itoa(cfg.ScreenWidth), strconv.Itoa(cfg.ScreenHeight)}...)
+	wineOptions := ""
 	if *cfg.IsWindowMode {
-		params = append(params, "-w")
-	} else {
-		params = append(params, "")
+		wineOptions = "-w"
 	}
-	if c.osType == Windows {
-		params = append(params, "windows")
-		params = append(params, "-vcodec", cfg.VideoCodec)
-	} else {
-		params = append(params, "")
+	// Mac doesn't have host mode in docker
+	dockerHost := "127.0.0.1"
+	networkMode := "host"
+	if c.osType == Mac {
+		dockerHost = "host.docker.internal"
+		networkMode = ""
+	}
+	sandbox := cfg.Sandbox
+	if sandbox.Network != "" {
+		// The app streams to the host through the bridge gateway
+		networkMode = sandbox.Network
+		if c.osType == Linux {
+			dockerHost = gateway
+		}
 	}
-	c.screenWidth = float32(cfg.ScreenWidth)
-	c.screenHeight = float32(cfg.ScreenHeight)
 
-	return c.runApp(execCmd, params)
+	spec := LaunchSpec{
+		Name:    c.ports.container,
+		Image:   cfg.Launcher.Image,
+		Command: cfg.Launcher.Command,
+		Env: map[string]string{
+			"apppath":        appPath,
+			"appfile":        cfg.AppFile,
+			"appname":        cfg.WindowTitle,
+			"hwkey":          hwKey,
+			"screenwidth":    strconv.Itoa(cfg.ScreenWidth),
+			"screenheight":   strconv.Itoa(cfg.ScreenHeight),
+			"wineoptions":    wineOptions,
+			"vcodec":         cfg.VideoCodec,
+			"dockerhost":     dockerHost,
+			"videoport":      strconv.Itoa(c.ports.video),
+			"audioport":      strconv.Itoa(c.ports.audio),
+			"inputport":      strconv.Itoa(c.ports.input),
+			"supervisorport": strconv.Itoa(c.ports.supervisor),
+			"DISPLAY":        ":99",
+		},
+		NetworkMode: networkMode,
+		Privileged:  !sandbox.DropPrivileges,
+		Resources: Resources{
+			NanoCPUs:    int64(sandbox.CPUs * 1e9),
+			MemoryBytes: sandbox.MemoryMB * 1024 * 1024,
+			PidsLimit:   sandbox.PidsLimit,
+		},
+	}
+	if cfg.Resize.Enabled() {
+		// the display is large enough for any allowed size, the stream captures the screen size
+		spec.Env["displaysize"] = fmt.Sprintf("%dx%d", cfg.Resize.MaxWidth, cfg.Resize.MaxHeight)
+	}
+	if sandbox.DropPrivileges {
+		spec.CapDrop = []string{"ALL"}
+		spec.CapAdd = sandbox.CapAdd
+		spec.SecurityOpt = []string{"no-new-privileges"}
+	}
+	if networkMode != "host" {
+		// The app only connects out to the host, supervisor is the one port to reach in
+		spec.Ports = []PortBinding{{HostIP: "127.0.0.1", HostPort: c.ports.supervisor, ContainerPort: c.ports.supervisor, Protocol: "tcp"}}
+	}
+
+	switch cfg.Launcher.Type {
+	case LauncherDocker, LauncherScript, "":
+		if c.osType == Windows {
+			break
+		}
+		if cfg.Launcher.Type == LauncherDocker && spec.Command == nil {
+			spec.Command = []string{"supervisord"}
+		}
+		mounts, err := c.appMounts(sandbox)
+		if err != nil {
+			return LaunchSpec{}, err
+		}
+		spec.Mounts = mounts
+	case LauncherProcess:
+		if spec.Command == nil {
+			// Same programs as the container, wine and ffmpeg installed on the host
+			spec.Command = []string{"supervisord", "-n", "-c", "winvm/supervisord.conf"}
+		}
+		if sandbox.CPUs > 0 || sandbox.MemoryMB > 0 || sandbox.PidsLimit > 0 || sandbox.DropPrivileges || sandbox.ReadOnlyApps {
+			c.log.Warn("Sandbox options are ignored by the process launcher")
+		}
+	}
+	return spec, nil
+}
+
+// appMounts returns the container mounts. With readOnlyApps, the apps are the
+// read-only lower layer of an overlay volume and the app writes to its own upper layer.
+func (c *ccImpl) appMounts(sandbox config.SandboxConfig) ([]Mount, error) {
+	winvm, err := filepath.Abs("winvm")
+	if err != nil {
+		return nil, err
+	}
+	apps := Mount{Type: "bind", Source: filepath.Join(winvm, "apps"), Target: "/apps"}
+	if sandbox.ReadOnlyApps {
+		apps.ReadOnly = true
+		if c.osType == Linux {
+			overlay, err := filepath.Abs(filepath.Join(sandbox.OverlayDir, c.ports.container))
+			if err != nil {
+				return nil, err
+			}
+			upper, work := filepath.Join(overlay, "upper"), filepath.Join(overlay, "work")
+			for _, dir := range []string{upper, work} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					return nil, err
+				}
+			}
+			apps = Mount{
+				Type:   "volume",
+				Source: c.ports.container + "-apps",
+				Target: "/apps",
+				DriverOpts: map[string]string{
+					"type":   "overlay",
+					"device": "overlay",
+					"o":      fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", apps.Source, upper, work),
+				},
+			}
+		}
+	}
+	return []Mount{
+		apps,
+		{Type: "bind", Source: filepath.Join(winvm, "supervisord.conf"), Target: "/etc/supervisor/conf.d/supervisord.conf", ReadOnly: true},
+		{Type: "volume", Source: "winecfg", Target: "/root/.wine"},
+	}, nil
 }
 
 // healthCheckVM to maintain connection with Virtual Machine
 func (c *ccImpl) healthCheckVM() {
-	log.Println("Starting health check")
-	for {
+	c.log.Debug("Starting the health check of the app VM")
+	for !c.isClosed() {
 		if c.wineConn != nil {
 			_, err := c.wineConn.Write([]byte{0})
 			if err != nil {
-				log.Println(err)
+				c.log.Debug("Health check of the app VM failed", "err", err)
 			}
 		}
 		time.Sleep(2 * time.Second)
 	}
 }
 
+// Handle sends the input to the app until it's closed
 func (c *ccImpl) Handle() {
-	for event := range c.appEvents {
-		c.SendInput(event)
+	for {
+		select {
+		case <-c.done:
+			return
+		case event := <-c.appEvents:
+			c.SendInput(event)
+		}
 	}
 }
 
-// newLocalStreamListener returns RTP: listener and SSRC of that listener
-func (c *ccImpl) newLocalStreamListener(rtpPort int) (*net.UDPConn, uint32) {
+// newLocalStreamListener returns RTP: listener and SSRC of that listener.
+// It fails if abort is closed before the first packet.
+func (c *ccImpl) newLocalStreamListener(rtpPort int, abort <-chan struct{}) (*net.UDPConn, uint32, error) {
 	// Open a UDP Listener for RTP Packets on port 5004
 	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("localhost"), Port: rtpPort})
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
 
 	// Listen for a single RTP Packet, we need this to determine the SSRC
+	received := make(chan struct{})
+	go func() {
+		select {
+		case <-abort:
+			// unblocks the read
+			listener.Close()
+		case <-received:
+		}
+	}()
 	inboundRTPPacket := make([]byte, 4096) // UDP MTU
 	n, _, err := listener.ReadFromUDP(inboundRTPPacket)
+	close(received)
 	if err != nil {
-		panic(err)
+		listener.Close()
+		return nil, 0, fmt.Errorf("no stream on port %d: %v", rtpPort, err)
 	}
 
 	// Unmarshal the incoming packet
 	packet := &rtp.Packet{}
 	if err = packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
-		panic(err)
+		listener.Close()
+		return nil, 0, err
 	}
 
-	return listener, packet.SSRC
+	return listener, packet.SSRC, nil
 }
 
 func (c *ccImpl) VideoStream() chan *rtp.Packet {
@@ -312,7 +640,7 @@ func (c *ccImpl) listenAudioStream() {
 	go func() {
 		defer func() {
 			c.audioListener.Close()
-			log.Println("Closing app VM")
+			c.log.Debug("Closed the stream listener", "stream", metrics.StreamAudio)
 		}()
 		r := ring.New(120)
 
@@ -330,18 +658,26 @@ func (c *ccImpl) listenAudioStream() {
 			r = r.Next()
 			n, _, err := c.audioListener.ReadFrom(inboundRTPPacket)
 			if err != nil {
-				log.Printf("error during read: %s", err)
+				if c.isClosed() {
+					return
+				}
+				c.log.Warn("Cannot read the stream", "stream", metrics.StreamAudio, "err", err)
 				continue
 			}
 
 			// TODOs: Don't assign packet here
 			packet := &rtp.Packet{}
 			if err := packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
-				log.Printf("error during unmarshalling a packet: %s", err)
+				c.log.Warn("Cannot unmarshal an RTP packet", "stream", metrics.StreamAudio, "err", err)
 				continue
 			}
 
-			c.audioStream <- packet
+			metrics.RTPPacketsIn.WithLabelValues(metrics.StreamAudio).Inc()
+			select {
+			case c.audioStream <- packet:
+			case <-c.done:
+				return
+			}
 		}
 	}()
 
@@ -354,7 +690,7 @@ func (c *ccImpl) listenVideoStream() {
 	go func() {
 		defer func() {
 			c.videoListener.Close()
-			log.Println("Closing app VM")
+			c.log.Debug("Closed the stream listener", "stream", metrics.StreamVideo)
 		}()
 		r := ring.New(120)
 
@@ -372,24 +708,34 @@ func (c *ccImpl) listenVideoStream() {
 			r = r.Next()
 			n, _, err := c.videoListener.ReadFrom(inboundRTPPacket)
 			if err != nil {
-				log.Printf("error during read: %s", err)
+				if c.isClosed() {
+					return
+				}
+				c.log.Warn("Cannot read the stream", "stream", metrics.StreamVideo, "err", err)
 				continue
 			}
 
 			// TODOs: Don't assign packet here
 			packet := &rtp.Packet{}
 			if err := packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
-				log.Printf("error during unmarshalling a packet: %s", err)
+				c.log.Warn("Cannot unmarshal an RTP packet", "stream", metrics.StreamVideo, "err", err)
 				continue
 			}
 
-			c.videoStream <- packet
+			c.lifecycle.OnPacket()
+			metrics.RTPPacketsIn.WithLabelValues(metrics.StreamVideo).Inc()
+			select {
+			case c.videoStream <- packet:
+			case <-c.done:
+				return
+			}
 		}
 	}()
 
 }
 
 func (c *ccImpl) SendInput(packet Packet) {
+	metrics.InputEvents.WithLabelValues(inputType(packet.Type)).Inc()
 	switch packet.Type {
 	case eventKeyUp:
 		c.simulateKey(packet.Data, 0)
@@ -401,7 +747,21 @@ func (c *ccImpl) SendInput(packet Packet) {
 		c.simulateMouseEvent(packet.Data, 1)
 	case eventMouseUp:
 		c.simulateMouseEvent(packet.Data, 2)
+	case eventResize:
+		// resizing restarts the stream, don't block the input
+		go c.resizeFromPayload(packet.Data)
+		return
 	}
+	packet.dispatched()
+}
+
+// inputType returns the type of the input for the metrics, the types sent by the browser are unbounded
+func inputType(t string) string {
+	switch t {
+	case eventKeyDown, eventKeyUp, eventMouseMove, eventMouseDown, eventMouseUp, eventResize:
+		return t
+	}
+	return "other"
 }
 
 func (c *ccImpl) simulateKey(jsonPayload string, keyState byte) {
@@ -409,17 +769,18 @@ func (c *ccImpl) simulateKey(jsonPayload string, keyState byte) {
 		return
 	}
 
-	log.Println("KeyDown event", jsonPayload)
 	type keydownPayload struct {
-		KeyCode int `json:keycode`
+		KeyCode int `json:"keycode"`
 	}
 	p := &keydownPayload{}
 	json.Unmarshal([]byte(jsonPayload), &p)
 
 	vmKeyMsg := fmt.Sprintf("K%d,%b|", p.KeyCode, keyState)
-	b, err := c.wineConn.Write([]byte(vmKeyMsg))
-	log.Printf("%+v\n", c.wineConn)
-	log.Println("Sended key: ", b, err)
+	if _, err := c.wineConn.Write([]byte(vmKeyMsg)); err != nil {
+		c.log.Warn("Cannot send the key to the app", "err", err)
+		return
+	}
+	c.log.Debug("Sent the key to the app", "key", p.KeyCode, "state", keyState)
 }
 
 // simulateMouseEvent handles mouse down event and send it to Virtual Machine over TCP port
@@ -428,22 +789,18 @@ func (c *ccImpl) simulateMouseEvent(jsonPayload string, mouseState int) {
 		return
 	}
 
-	type mousePayload struct {
-		IsLeft byte    `json:isLeft`
-		X      float32 `json:x`
-		Y      float32 `json:y`
-		Width  float32 `json:width`
-		Height float32 `json:height`
+	p, err := parseMousePayload(jsonPayload)
+	if err != nil {
+		c.log.Warn("Invalid mouse event", "err", err)
+		return
 	}
-	p := &mousePayload{}
-	json.Unmarshal([]byte(jsonPayload), &p)
-	p.X = p.X * c.screenWidth / p.Width
-	p.Y = p.Y * c.screenHeight / p.Height
+	screenWidth, screenHeight := c.screenSize()
+	p.X, p.Y = screenMapper{screenWidth: screenWidth, screenHeight: screenHeight}.Map(p)
 
 	// Mouse is in format of comma separated "12.4,52.3"
 	vmMouseMsg := fmt.Sprintf("M%d,%d,%f,%f,%f,%f|", p.IsLeft, mouseState, p.X, p.Y, p.Width, p.Height)
-	_, err := c.wineConn.Write([]byte(vmMouseMsg))
+	_, err = c.wineConn.Write([]byte(vmMouseMsg))
 	if err != nil {
-		fmt.Println("Err: ", err)
+		c.log.Warn("Cannot send the mouse event to the app", "err", err)
 	}
 }
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp"
 )
 
-const configFilePath = "./config.yaml"
+// shutdownTimeout bounds the graceful shutdown
+const shutdownTimeout = 15 * time.Second
 
 func monitor() {
 	monitoringServerMux := http.NewServeMux()
@@ -21,10 +27,10 @@ func monitor() {
 		Addr:    fmt.Sprintf(":%d", 3535),
 		Handler: monitoringServerMux,
 	}
-	log.Println("Starting monitoring server at", srv.Addr)
+	slog.Info("Starting the monitoring server", "addr", srv.Addr)
 
 	pprofPath := "/debug/pprof"
-	log.Println("Profiling is enabled at", srv.Addr+pprofPath)
+	slog.Info("Profiling is enabled", "addr", srv.Addr+pprofPath)
 	monitoringServerMux.Handle(pprofPath+"/", http.HandlerFunc(pprof.Index))
 	monitoringServerMux.Handle(pprofPath+"/cmdline", http.HandlerFunc(pprof.Cmdline))
 	monitoringServerMux.Handle(pprofPath+"/profile", http.HandlerFunc(pprof.Profile))
@@ -38,31 +44,58 @@ func monitor() {
 	monitoringServerMux.Handle(pprofPath+"/heap", pprof.Handler("heap"))
 	monitoringServerMux.Handle(pprofPath+"/mutex", pprof.Handler("mutex"))
 	monitoringServerMux.Handle(pprofPath+"/threadcreate", pprof.Handler("threadcreate"))
+	slog.Info("Metrics are enabled", "addr", srv.Addr+"/metrics")
+	monitoringServerMux.Handle("/metrics", metrics.Handler())
 	go srv.ListenAndServe()
 }
 
 func main() {
-	cfg, err := config.ReadConfig(configFilePath)
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(config.ValidateCommand(os.Args[0], os.Args[2:], os.Stdout))
+	}
+	configPath, overrides, err := config.ParseFlags(os.Args[0], os.Args[1:], os.Stderr)
+	if err != nil {
+		os.Exit(2)
+	}
+	cfg, err := config.Load(configPath, overrides)
 	if err != nil {
-		panic(err)
+		slog.Error("Cannot load the config", "err", err)
+		os.Exit(1)
 	}
+	logging.Setup(cfg.Log)
 	// TODO: Make the communication over websocket
 	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
 	server := cloudapp.NewServer(cfg)
 	server.Handle()
 
+	watcher := config.NewWatcher(configPath, overrides)
+	defer watcher.Close()
+	go func() {
+		for cfg := range watcher.Updates() {
+			server.Reload(cfg)
+		}
+	}()
+
 	go func() {
 		err := server.ListenAndServe()
-		if err != nil {
-			log.Fatal(err)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	select {
-	case <-stop:
-		log.Println("Received SIGTERM, Quiting")
-		server.Shutdown()
+	case sig := <-stop:
+		slog.Info("Received a signal, quitting", "signal", sig.String())
+	case <-server.Done():
+		slog.Info("App is shut down, quitting")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Shutdown failed", "err", err)
 	}
 }
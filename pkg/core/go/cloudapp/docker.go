@@ -0,0 +1,361 @@
+package cloudapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerStopTimeout is the seconds docker waits before killing a stopping container
+const dockerStopTimeout = 10
+
+// dockerLauncher runs app containers through the Docker Engine API
+type dockerLauncher struct {
+	client  *http.Client
+	baseURL string
+	log     *slog.Logger
+}
+
+// newDockerLauncher connects to the Docker Engine listening at host, ex. unix:///var/run/docker.sock
+func newDockerLauncher(host string) *dockerLauncher {
+	if host == "" {
+		host = defaultDockerHost
+	}
+	if strings.HasPrefix(host, "tcp://") {
+		return newDockerLauncherWithClient(&http.Client{}, "http://"+strings.TrimPrefix(host, "tcp://"))
+	}
+
+	sock := strings.TrimPrefix(host, "unix://")
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}
+	// host part of the URL is ignored when dialing the socket
+	return newDockerLauncherWithClient(&http.Client{Transport: transport}, "http://docker")
+}
+
+// newDockerLauncherWithClient talks to the Engine API at baseURL, ex. a fake engine in tests
+func newDockerLauncherWithClient(client *http.Client, baseURL string) *dockerLauncher {
+	return &dockerLauncher{
+		client:  client,
+		baseURL: baseURL,
+		log:     slog.Default(),
+	}
+}
+
+// Engine API payloads, see https://docs.docker.com/engine/api/v1.41/#operation/ContainerCreate
+type dockerContainerConfig struct {
+	Image        string
+	Cmd          []string            `json:",omitempty"`
+	Env          []string            `json:",omitempty"`
+	WorkingDir   string              `json:",omitempty"`
+	ExposedPorts map[string]struct{} `json:",omitempty"`
+	Tty          bool
+	HostConfig   dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	Mounts       []dockerMount                  `json:",omitempty"`
+	PortBindings map[string][]dockerPortBinding `json:",omitempty"`
+	NetworkMode  string                         `json:",omitempty"`
+	Privileged   bool
+	CapDrop      []string `json:",omitempty"`
+	CapAdd       []string `json:",omitempty"`
+	SecurityOpt  []string `json:",omitempty"`
+	AutoRemove   bool
+	NanoCpus     int64  `json:",omitempty"`
+	Memory       int64  `json:",omitempty"`
+	PidsLimit    *int64 `json:",omitempty"`
+}
+
+type dockerMount struct {
+	Type          string
+	Source        string
+	Target        string
+	ReadOnly      bool
+	VolumeOptions *dockerVolumeOptions `json:",omitempty"`
+}
+
+// dockerVolumeOptions creates the volume with the driver options if it doesn't exist
+type dockerVolumeOptions struct {
+	DriverConfig struct {
+		Name    string
+		Options map[string]string
+	}
+}
+
+type dockerNetworkCreate struct {
+	Name           string
+	Driver         string
+	Internal       bool
+	CheckDuplicate bool
+}
+
+type dockerNetwork struct {
+	Name string
+	IPAM struct {
+		Config []dockerIPAMConfig
+	}
+}
+
+type dockerIPAMConfig struct {
+	Subnet  string
+	Gateway string
+}
+
+type dockerExecConfig struct {
+	Cmd          []string
+	AttachStdout bool
+	AttachStderr bool
+	Tty          bool
+}
+
+type dockerExecStart struct {
+	Detach bool
+	Tty    bool
+}
+
+type dockerExecInspect struct {
+	Running  bool
+	ExitCode int
+}
+
+type dockerPortBinding struct {
+	HostIp   string
+	HostPort string
+}
+
+type dockerCreateResponse struct {
+	Id       string
+	Warnings []string
+}
+
+type dockerWaitResponse struct {
+	StatusCode int
+	Error      *struct {
+		Message string
+	}
+}
+
+type dockerErrorResponse struct {
+	Message string `json:"message"`
+}
+
+func (l *dockerLauncher) Launch(spec LaunchSpec) (Process, error) {
+	// Remove the leftover of a previous run
+	if err := l.do(http.MethodDelete, "/containers/"+spec.Name+"?force=true", nil, nil); err != nil && !isDockerNotFound(err) {
+		return nil, err
+	}
+
+	var created dockerCreateResponse
+	query := url.Values{"name": {spec.Name}}
+	if err := l.do(http.MethodPost, "/containers/create?"+query.Encode(), newDockerContainerConfig(spec), &created); err != nil {
+		return nil, fmt.Errorf("create container %s: %v", spec.Name, err)
+	}
+	for _, w := range created.Warnings {
+		l.log.Warn("Docker warning", "warning", w)
+	}
+
+	if err := l.do(http.MethodPost, "/containers/"+created.Id+"/start", nil, nil); err != nil {
+		return nil, fmt.Errorf("start container %s: %v", spec.Name, err)
+	}
+	l.log.Info("Started the container", "id", created.Id)
+
+	return &dockerProcess{launcher: l, id: created.Id}, nil
+}
+
+func newDockerContainerConfig(spec LaunchSpec) dockerContainerConfig {
+	c := dockerContainerConfig{
+		Image:      spec.Image,
+		Cmd:        spec.Command,
+		WorkingDir: spec.WorkDir,
+		Tty:        true,
+		HostConfig: dockerHostConfig{
+			NetworkMode: spec.NetworkMode,
+			Privileged:  spec.Privileged,
+			AutoRemove:  true,
+			NanoCpus:    spec.Resources.NanoCPUs,
+			Memory:      spec.Resources.MemoryBytes,
+		},
+	}
+	if spec.Resources.PidsLimit > 0 {
+		c.HostConfig.PidsLimit = &spec.Resources.PidsLimit
+	}
+	for k, v := range spec.Env {
+		c.Env = append(c.Env, k+"="+v)
+	}
+	for _, m := range spec.Mounts {
+		mount := dockerMount{
+			Type:     m.Type,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+		if m.DriverOpts != nil {
+			mount.VolumeOptions = &dockerVolumeOptions{}
+			mount.VolumeOptions.DriverConfig.Name = "local"
+			mount.VolumeOptions.DriverConfig.Options = m.DriverOpts
+		}
+		c.HostConfig.Mounts = append(c.HostConfig.Mounts, mount)
+	}
+	if len(spec.Ports) > 0 {
+		c.ExposedPorts = map[string]struct{}{}
+		c.HostConfig.PortBindings = map[string][]dockerPortBinding{}
+		for _, p := range spec.Ports {
+			key := strconv.Itoa(p.ContainerPort) + "/" + p.Protocol
+			c.ExposedPorts[key] = struct{}{}
+			c.HostConfig.PortBindings[key] = append(c.HostConfig.PortBindings[key], dockerPortBinding{HostIp: p.HostIP, HostPort: strconv.Itoa(p.HostPort)})
+		}
+	}
+	return c
+}
+
+// PrepareNetwork creates the bridge network if missing and returns its gateway IP
+func (l *dockerLauncher) PrepareNetwork(name string, internal bool) (string, error) {
+	var network dockerNetwork
+	err := l.do(http.MethodGet, "/networks/"+name, nil, &network)
+	if isDockerNotFound(err) {
+		create := dockerNetworkCreate{Name: name, Driver: "bridge", Internal: internal, CheckDuplicate: true}
+		if err := l.do(http.MethodPost, "/networks/create", create, nil); err != nil {
+			return "", fmt.Errorf("create network %s: %v", name, err)
+		}
+		l.log.Info("Created the network", "network", name)
+		err = l.do(http.MethodGet, "/networks/"+name, nil, &network)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, c := range network.IPAM.Config {
+		if c.Gateway != "" {
+			return c.Gateway, nil
+		}
+	}
+	return "", fmt.Errorf("network %s has no gateway", name)
+}
+
+// Exec runs the command in the container and waits for it
+func (l *dockerLauncher) Exec(name string, cmd []string) error {
+	var created dockerCreateResponse
+	config := dockerExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true, Tty: true}
+	if err := l.do(http.MethodPost, "/containers/"+name+"/exec", config, &created); err != nil {
+		return fmt.Errorf("exec in %s: %v", name, err)
+	}
+	// the output is streamed until the command exits
+	var out bytes.Buffer
+	if err := l.do(http.MethodPost, "/exec/"+created.Id+"/start", dockerExecStart{Tty: true}, &out); err != nil {
+		return fmt.Errorf("exec in %s: %v", name, err)
+	}
+	var inspect dockerExecInspect
+	if err := l.do(http.MethodGet, "/exec/"+created.Id+"/json", nil, &inspect); err != nil {
+		return fmt.Errorf("exec in %s: %v", name, err)
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("exec in %s: exit status %d %s", name, inspect.ExitCode, out.String())
+	}
+	return nil
+}
+
+// do sends a request to the Engine API and decodes the JSON response into out,
+// or copies the raw response if out is an io.Writer
+func (l *dockerLauncher) do(method string, path string, in interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, l.baseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e dockerErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &dockerError{StatusCode: resp.StatusCode, Message: e.Message}
+	}
+	if w, ok := out.(io.Writer); ok {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// dockerError is an error returned by the Engine API
+type dockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker: %d %s", e.StatusCode, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+	e, ok := err.(*dockerError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// dockerProcess is a running container
+type dockerProcess struct {
+	launcher *dockerLauncher
+	id       string
+}
+
+func (p *dockerProcess) Wait() error {
+	var resp dockerWaitResponse
+	if err := p.launcher.do(http.MethodPost, "/containers/"+p.id+"/wait", nil, &resp); err != nil {
+		if isDockerNotFound(err) {
+			// already removed
+			return nil
+		}
+		return err
+	}
+	if resp.Error != nil && resp.Error.Message != "" {
+		return fmt.Errorf("container %s: %s", p.id, resp.Error.Message)
+	}
+	if resp.StatusCode != 0 {
+		return fmt.Errorf("container %s exited with status %d", p.id, resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *dockerProcess) Stop() error {
+	err := p.launcher.do(http.MethodPost, fmt.Sprintf("/containers/%s/stop?t=%d", p.id, dockerStopTimeout), nil, nil)
+	if isDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *dockerProcess) Kill() error {
+	err := p.launcher.do(http.MethodDelete, "/containers/"+p.id+"?force=true", nil, nil)
+	if isDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// fakeDockerEngine is an in-memory Docker Engine API for tests.
+// Serve it with httptest and pass its URL to newDockerLauncherWithClient.
+type fakeDockerEngine struct {
+	lock       sync.Mutex
+	containers map[string]*fakeContainer
+	// names maps container names to IDs
+	names    map[string]string
+	networks map[string]dockerNetwork
+	// execs are the commands run in the containers, by exec ID
+	execs map[string]fakeExec
+}
+
+type fakeExec struct {
+	container string
+	cmd       []string
+}
+
+type fakeContainer struct {
+	id      string
+	config  dockerContainerConfig
+	running bool
+	exited  chan struct{}
+}
+
+func newFakeDockerEngine() *fakeDockerEngine {
+	return &fakeDockerEngine{
+		containers: map[string]*fakeContainer{},
+		names:      map[string]string{},
+		networks:   map[string]dockerNetwork{},
+		execs:      map[string]fakeExec{},
+	}
+}
+
+func (f *fakeDockerEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/networks/") {
+		f.serveNetwork(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/exec/") {
+		f.serveExec(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/containers/")
+
+	if r.Method == http.MethodPost && path == "create" {
+		var config dockerContainerConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeFakeDockerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(dockerCreateResponse{Id: f.create(r.URL.Query().Get("name"), config)})
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 2)
+	c := f.get(parts[0])
+	if c == nil {
+		writeFakeDockerError(w, http.StatusNotFound, "No such container: "+parts[0])
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case r.Method == http.MethodPost && action == "start":
+		f.lock.Lock()
+		c.running = true
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && action == "wait":
+		<-c.exited
+		json.NewEncoder(w).Encode(dockerWaitResponse{})
+	case r.Method == http.MethodPost && action == "exec":
+		var config dockerExecConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeFakeDockerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id := uuid.Must(uuid.NewV4()).String()
+		f.lock.Lock()
+		f.execs[id] = fakeExec{container: c.id, cmd: config.Cmd}
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(dockerCreateResponse{Id: id})
+	case r.Method == http.MethodPost && (action == "stop" || action == "kill"):
+		f.remove(c)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && action == "":
+		f.remove(c)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeDockerError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (f *fakeDockerEngine) serveNetwork(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/networks/")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.Method == http.MethodPost && name == "create" {
+		var create dockerNetworkCreate
+		if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+			writeFakeDockerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		network := dockerNetwork{Name: create.Name}
+		network.IPAM.Config = append(network.IPAM.Config, dockerIPAMConfig{
+			Subnet:  fmt.Sprintf("172.%d.0.0/16", 18+len(f.networks)),
+			Gateway: fmt.Sprintf("172.%d.0.1", 18+len(f.networks)),
+		})
+		f.networks[create.Name] = network
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	network, ok := f.networks[name]
+	if r.Method != http.MethodGet || !ok {
+		writeFakeDockerError(w, http.StatusNotFound, "network "+name+" not found")
+		return
+	}
+	json.NewEncoder(w).Encode(network)
+}
+
+// serveExec runs the commands instantly with success
+func (f *fakeDockerEngine) serveExec(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/exec/"), "/", 2)
+	f.lock.Lock()
+	_, ok := f.execs[parts[0]]
+	f.lock.Unlock()
+	if !ok || len(parts) < 2 {
+		writeFakeDockerError(w, http.StatusNotFound, "No such exec instance")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && parts[1] == "start":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && parts[1] == "json":
+		json.NewEncoder(w).Encode(dockerExecInspect{})
+	default:
+		writeFakeDockerError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// Execs returns the commands run in the container with the name
+func (f *fakeDockerEngine) Execs(name string) [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var cmds [][]string
+	for _, e := range f.execs {
+		if e.container == f.names[name] {
+			cmds = append(cmds, e.cmd)
+		}
+	}
+	return cmds
+}
+
+// Running returns the config of the running container with the name
+func (f *fakeDockerEngine) Running(name string) (dockerContainerConfig, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c, ok := f.containers[f.names[name]]
+	if !ok || !c.running {
+		return dockerContainerConfig{}, false
+	}
+	return c.config, true
+}
+
+func (f *fakeDockerEngine) create(name string, config dockerContainerConfig) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	id := uuid.Must(uuid.NewV4()).String()
+	f.containers[id] = &fakeContainer{id: id, config: config, exited: make(chan struct{})}
+	if name != "" {
+		f.names[name] = id
+	}
+	return id
+}
+
+func (f *fakeDockerEngine) get(idOrName string) *fakeContainer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if id, ok := f.names[idOrName]; ok {
+		idOrName = id
+	}
+	return f.containers[idOrName]
+}
+
+// remove stops and removes the container, as AutoRemove does
+func (f *fakeDockerEngine) remove(c *fakeContainer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.containers[c.id]; !ok {
+		return
+	}
+	delete(f.containers, c.id)
+	for name, id := range f.names {
+		if id == c.id {
+			delete(f.names, name)
+		}
+	}
+	c.running = false
+	close(c.exited)
+}
+
+func writeFakeDockerError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(dockerErrorResponse{Message: msg})
+}
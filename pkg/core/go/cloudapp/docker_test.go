@@ -0,0 +1,231 @@
+package cloudapp
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+func newTestDockerLauncher(t *testing.T) (*dockerLauncher, *fakeDockerEngine) {
+	engine := newFakeDockerEngine()
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+	return newDockerLauncherWithClient(srv.Client(), srv.URL), engine
+}
+
+func testLaunchSpec() LaunchSpec {
+	return LaunchSpec{
+		Name:    "cloudapp-0",
+		Image:   "syncwine",
+		Command: []string{"supervisord"},
+		Env:     map[string]string{"appname": "notepad"},
+		Mounts:  []Mount{{Type: "bind", Source: "/apps", Target: "/apps", ReadOnly: true}},
+		Ports: []PortBinding{
+			{HostIP: "127.0.0.1", HostPort: 9001, ContainerPort: 9001, Protocol: "tcp"},
+			{HostPort: 5004, ContainerPort: 5004, Protocol: "udp"},
+		},
+		Resources: Resources{NanoCPUs: 2e9, PidsLimit: 512},
+	}
+}
+
+func TestDockerLaunch(t *testing.T) {
+	launcher, engine := newTestDockerLauncher(t)
+	spec := testLaunchSpec()
+
+	if _, err := launcher.Launch(spec); err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+	config, ok := engine.Running(spec.Name)
+	if !ok {
+		t.Fatalf("container %s is not running", spec.Name)
+	}
+	if config.Image != spec.Image || !reflect.DeepEqual(config.Cmd, spec.Command) {
+		t.Errorf("image and cmd = %s %v, want %s %v", config.Image, config.Cmd, spec.Image, spec.Command)
+	}
+	if !reflect.DeepEqual(config.Env, []string{"appname=notepad"}) {
+		t.Errorf("env = %v", config.Env)
+	}
+	if !config.HostConfig.AutoRemove {
+		t.Error("container is not auto removed")
+	}
+	if len(config.HostConfig.Mounts) != 1 || !config.HostConfig.Mounts[0].ReadOnly {
+		t.Errorf("mounts = %+v", config.HostConfig.Mounts)
+	}
+	if p := config.HostConfig.PidsLimit; p == nil || *p != 512 {
+		t.Errorf("pids limit = %v, want 512", p)
+	}
+	for _, key := range []string{"9001/tcp", "5004/udp"} {
+		if _, ok := config.ExposedPorts[key]; !ok {
+			t.Errorf("port %s is not exposed", key)
+		}
+	}
+	// the supervisor port is only published on loopback
+	want := map[string][]dockerPortBinding{
+		"9001/tcp": {{HostIp: "127.0.0.1", HostPort: "9001"}},
+		"5004/udp": {{HostPort: "5004"}},
+	}
+	if !reflect.DeepEqual(config.HostConfig.PortBindings, want) {
+		t.Errorf("port bindings = %+v, want %+v", config.HostConfig.PortBindings, want)
+	}
+}
+
+func TestDockerStop(t *testing.T) {
+	launcher, engine := newTestDockerLauncher(t)
+	spec := testLaunchSpec()
+	p, err := launcher.Launch(spec)
+	if err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- p.Wait() }()
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("Wait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after Stop")
+	}
+	if _, ok := engine.Running(spec.Name); ok {
+		t.Error("container is still running after Stop")
+	}
+	// the container is already removed
+	if err := p.Stop(); err != nil {
+		t.Errorf("second Stop: %v", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Errorf("Wait of a removed container: %v", err)
+	}
+}
+
+func TestDockerKill(t *testing.T) {
+	launcher, engine := newTestDockerLauncher(t)
+	spec := testLaunchSpec()
+	p, err := launcher.Launch(spec)
+	if err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+	if err := p.Kill(); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+	if _, ok := engine.Running(spec.Name); ok {
+		t.Error("container is still running after Kill")
+	}
+	if err := p.Kill(); err != nil {
+		t.Errorf("second Kill: %v", err)
+	}
+}
+
+func TestDockerLaunchRemovesOrphan(t *testing.T) {
+	launcher, engine := newTestDockerLauncher(t)
+	spec := testLaunchSpec()
+	// a container left by a previous run of the server
+	orphan := engine.create(spec.Name, dockerContainerConfig{Image: "old"})
+	engine.get(orphan).running = true
+
+	if _, err := launcher.Launch(spec); err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+	if engine.get(orphan) != nil {
+		t.Error("orphan container is not removed")
+	}
+	config, ok := engine.Running(spec.Name)
+	if !ok || config.Image != spec.Image {
+		t.Errorf("running container = %+v %v, want the launched one", config, ok)
+	}
+}
+
+func TestDockerPrepareNetwork(t *testing.T) {
+	launcher, _ := newTestDockerLauncher(t)
+
+	gateway, err := launcher.PrepareNetwork("cloudmorph", true)
+	if err != nil {
+		t.Fatalf("PrepareNetwork: %v", err)
+	}
+	if gateway == "" {
+		t.Fatal("no gateway")
+	}
+	again, err := launcher.PrepareNetwork("cloudmorph", true)
+	if err != nil || again != gateway {
+		t.Errorf("PrepareNetwork of an existing network = %s %v, want %s", again, err, gateway)
+	}
+}
+
+func TestDockerExec(t *testing.T) {
+	launcher, engine := newTestDockerLauncher(t)
+	spec := testLaunchSpec()
+	if _, err := launcher.Launch(spec); err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+	cmd := []string{"supervisorctl", "restart", "wine"}
+	if err := launcher.Exec(spec.Name, cmd); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if execs := engine.Execs(spec.Name); !reflect.DeepEqual(execs, [][]string{cmd}) {
+		t.Errorf("execs = %v, want %v", execs, [][]string{cmd})
+	}
+	if err := launcher.Exec("missing", cmd); err == nil {
+		t.Error("Exec in a missing container succeeded")
+	}
+}
+
+func TestLaunchSpecSandboxNetwork(t *testing.T) {
+	windowMode := true
+	cfg := config.Config{
+		ScreenWidth:  800,
+		ScreenHeight: 600,
+		IsWindowMode: &windowMode,
+		Launcher:     config.LauncherConfig{Type: LauncherDocker, Image: "syncwine"},
+		Sandbox:      config.SandboxConfig{Network: "cloudmorph"},
+	}
+	c := &ccImpl{ports: newAppPorts(1), osType: Linux}
+	spec, err := c.launchSpec(cfg, "172.18.0.1")
+	if err != nil {
+		t.Fatalf("launchSpec: %v", err)
+	}
+	if spec.NetworkMode != "cloudmorph" {
+		t.Errorf("network = %q, want cloudmorph", spec.NetworkMode)
+	}
+
+	// ffmpeg streams to and syncinput connects to the docker host, the gateway of the bridge
+	launcher, engine := newTestDockerLauncher(t)
+	if _, err := launcher.Launch(spec); err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+	container, ok := engine.Running(spec.Name)
+	if !ok {
+		t.Fatalf("container %s is not running", spec.Name)
+	}
+	env := map[string]bool{}
+	for _, e := range container.Env {
+		env[e] = true
+	}
+	for _, want := range []string{"dockerhost=172.18.0.1", "inputport=9091"} {
+		if !env[want] {
+			t.Errorf("env %v has no %s", container.Env, want)
+		}
+	}
+	conf, err := os.ReadFile("../../../../winvm/supervisord.conf")
+	if err != nil {
+		t.Fatalf("cannot read supervisord.conf: %v", err)
+	}
+	syncinput := regexp.MustCompile(`(?m)^command=wine syncinput.exe (.*)$`).FindSubmatch(conf)
+	if syncinput == nil {
+		t.Fatal("supervisord.conf doesn't run syncinput")
+	}
+	// syncinput.exe title hwkey dockerhost hostIP inputport
+	args := strings.Fields(string(syncinput[1]))
+	if len(args) != 5 || args[3] != "%(ENV_dockerhost)s" || args[4] != "%(ENV_inputport)s" {
+		t.Errorf("syncinput args = %v, want the docker host as the host IP", args)
+	}
+}
@@ -0,0 +1,175 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// The latency of a client is measured on each leg of an input:
+//
+//   browser -> server -> app      half the ping round trip, then the dispatch
+//   app -> encoder                 not measured, it's inside the app VM
+//   server -> browser              half the ping round trip, plus the jitter
+//
+// The server pings the browser over the data channel, the browser echoes the ping
+// on the control channel. The report is pushed back to the browser for its overlay.
+
+const (
+	// latencyProbeInterval is the interval of the pings and the pushed reports
+	latencyProbeInterval = 2 * time.Second
+	// latencyWindowSize is the number of samples of the rolling window, a minute of pings
+	latencyWindowSize = 30
+	// maxPingAge drops the pongs of stale pings
+	maxPingAge = 10 * time.Second
+	eventPong  = "PONG"
+)
+
+// messageLatency pushes LatencyReport over the data channel
+var messageLatency = webrtc.RegisterMessage("LATENCY", LatencyReport{}, true)
+
+// LatencyStats summarizes a rolling window of samples, in milliseconds
+type LatencyStats struct {
+	Last float64 `json:"last_ms"`
+	Avg  float64 `json:"avg_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// LatencyReport is the latency of a client
+type LatencyReport struct {
+	ClientID string `json:"client_id"`
+	// Ping is the round trip of the data channel, browser to server and back
+	Ping LatencyStats `json:"ping"`
+	// Dispatch is the time from the input received to it written to the app
+	Dispatch LatencyStats `json:"dispatch"`
+	// NetworkRTT and Jitter are reported by the browser in RTCP for the video
+	NetworkRTT float64 `json:"network_rtt_ms"`
+	Jitter     float64 `json:"jitter_ms"`
+	// InputToPhoton is the average input to photon without the render and encoding
+	// of the app and the decoding of the browser, which aren't measured
+	InputToPhoton float64 `json:"input_to_photon_ms"`
+}
+
+// latencyWindow keeps the recent samples of a latency
+type latencyWindow struct {
+	samples [latencyWindowSize]time.Duration
+	n       int
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+	if w.n < latencyWindowSize {
+		w.n++
+	}
+}
+
+func (w *latencyWindow) stats() LatencyStats {
+	if w.n == 0 {
+		return LatencyStats{}
+	}
+	var sum, max time.Duration
+	for _, d := range w.samples[:w.n] {
+		sum += d
+		if d > max {
+			max = d
+		}
+	}
+	last := w.samples[(w.next+latencyWindowSize-1)%latencyWindowSize]
+	return LatencyStats{Last: ms(last), Avg: ms(sum / time.Duration(w.n)), Max: ms(max)}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// latencyTracker measures the latency of a client
+type latencyTracker struct {
+	lock     sync.Mutex
+	ping     latencyWindow
+	dispatch latencyWindow
+	nextPing uint32
+}
+
+// newPing returns the next ping to send to the browser
+func (t *latencyTracker) newPing() webrtc.Ping {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nextPing++
+	return webrtc.Ping{ID: t.nextPing, Time: time.Now().UnixNano() / int64(time.Millisecond)}
+}
+
+// pong records the round trip of the ping echoed by the browser
+func (t *latencyTracker) pong(data string) error {
+	ping := webrtc.Ping{}
+	if err := json.Unmarshal([]byte(data), &ping); err != nil {
+		return err
+	}
+	rtt := time.Since(time.Unix(0, ping.Time*int64(time.Millisecond)))
+	if rtt < 0 || rtt > maxPingAge {
+		return nil
+	}
+	t.lock.Lock()
+	t.ping.add(rtt)
+	t.lock.Unlock()
+	return nil
+}
+
+// dispatched records the time an input took to reach the app
+func (t *latencyTracker) dispatched(d time.Duration) {
+	t.lock.Lock()
+	t.dispatch.add(d)
+	t.lock.Unlock()
+}
+
+// report returns the latency of the client over the peer
+func (t *latencyTracker) report(clientID string, peer *webrtc.WebRTC) LatencyReport {
+	t.lock.Lock()
+	r := LatencyReport{ClientID: clientID, Ping: t.ping.stats(), Dispatch: t.dispatch.stats()}
+	t.lock.Unlock()
+	if peer != nil {
+		network := peer.NetworkStats()
+		r.NetworkRTT = ms(network.RTT)
+		r.Jitter = ms(network.Jitter)
+	}
+	r.InputToPhoton = r.Ping.Avg + r.Dispatch.Avg + r.Jitter
+	return r
+}
+
+// probeLatency pings the browser and pushes its latency report until the peer is stopped
+func (c *Client) probeLatency(peer *webrtc.WebRTC) {
+	ticker := time.NewTicker(latencyProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.Done():
+			return
+		case <-ticker.C:
+		}
+		if !peer.IsConnected() {
+			continue
+		}
+		if err := peer.Send(webrtc.MessagePing, c.latency.newPing()); err != nil {
+			continue
+		}
+		if err := peer.Send(messageLatency, c.latency.report(c.clientID, peer)); err != nil {
+			c.log.Warn("Cannot push the latency", "err", err)
+		}
+	}
+}
+
+// LatencyReports returns the latency of the clients with a peer
+func (s *Service) LatencyReports() []LatencyReport {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	reports := []LatencyReport{}
+	for _, client := range s.clients {
+		if peer := client.peer(); peer != nil {
+			reports = append(reports, client.latency.report(client.clientID, peer))
+		}
+	}
+	return reports
+}
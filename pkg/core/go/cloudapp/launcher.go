@@ -0,0 +1,370 @@
+package cloudapp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+const (
+	// LauncherScript runs the platform script (run-wine.sh, run-app.ps1)
+	LauncherScript = "script"
+	// LauncherProcess runs the app command as a local process
+	LauncherProcess = "process"
+	// LauncherDocker runs the app container through the Docker Engine API
+	LauncherDocker = "docker"
+)
+
+// LaunchSpec describes an app instance to launch
+type LaunchSpec struct {
+	// Name of the container or the instance
+	Name    string
+	Image   string
+	Command []string
+	WorkDir string
+	// Env carries the app settings: apppath, appfile, appname, hwkey, screenwidth, ...
+	Env         map[string]string
+	Mounts      []Mount
+	Ports       []PortBinding
+	NetworkMode string
+	Privileged  bool
+	CapDrop     []string
+	CapAdd      []string
+	SecurityOpt []string
+	Resources   Resources
+}
+
+// Mount is a host path or a named volume mounted into the instance
+type Mount struct {
+	// Type is bind or volume
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool
+	// DriverOpts creates the volume with the local driver options, ex. an overlay
+	DriverOpts map[string]string
+}
+
+// PortBinding publishes a container port on the host
+type PortBinding struct {
+	// HostIP restricts the published port to an address, ex. 127.0.0.1
+	HostIP        string
+	HostPort      int
+	ContainerPort int
+	// Protocol is tcp or udp
+	Protocol string
+}
+
+// Resources limits the instance. Zero is unlimited.
+type Resources struct {
+	NanoCPUs    int64
+	MemoryBytes int64
+	PidsLimit   int64
+}
+
+// Launcher starts app instances
+type Launcher interface {
+	Launch(spec LaunchSpec) (Process, error)
+}
+
+// Process is a launched app instance
+type Process interface {
+	// Wait blocks until the instance exits
+	Wait() error
+	// Stop asks the instance to exit gracefully
+	Stop() error
+	// Kill stops the instance immediately
+	Kill() error
+}
+
+// networkPreparer is a launcher able to run instances in a dedicated bridge network
+type networkPreparer interface {
+	// PrepareNetwork creates the network if missing and returns its gateway IP
+	PrepareNetwork(name string, internal bool) (string, error)
+}
+
+// commandRunner is a launcher able to run a command in a launched instance
+type commandRunner interface {
+	// Exec runs the command in the instance named name and waits for it
+	Exec(name string, cmd []string) error
+}
+
+// NewLauncher returns the launcher selected in config, logging to the logger of the instance
+func NewLauncher(cfg config.Config, osType osTypeEnum, logger *slog.Logger) (Launcher, error) {
+	switch cfg.Launcher.Type {
+	case LauncherScript, "":
+		return &scriptLauncher{osType: osType, virtualized: cfg.IsVirtualized, log: logger}, nil
+	case LauncherProcess:
+		return &processLauncher{log: logger}, nil
+	case LauncherDocker:
+		l := newDockerLauncher(cfg.Launcher.DockerHost)
+		l.log = logger
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unknown launcher %q", cfg.Launcher.Type)
+	}
+}
+
+// processLauncher runs the spec command on the host
+type processLauncher struct {
+	log *slog.Logger
+}
+
+func (l *processLauncher) Launch(spec LaunchSpec) (Process, error) {
+	if len(spec.Command) == 0 {
+		return nil, fmt.Errorf("no command to launch %s", spec.Name)
+	}
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	cmd.Dir = spec.WorkDir
+	cmd.Env = os.Environ()
+	for k, v := range spec.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	return startProcess(cmd, l.log)
+}
+
+// Exec runs the command on the host, where the instance runs
+func (l *processLauncher) Exec(name string, cmd []string) error {
+	if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("exec in %s: %v %s", name, err, out)
+	}
+	return nil
+}
+
+// scriptLauncher keeps the legacy flow: the platform script takes the spec as positional args
+type scriptLauncher struct {
+	osType      osTypeEnum
+	virtualized bool
+	log         *slog.Logger
+}
+
+func (l *scriptLauncher) Launch(spec LaunchSpec) (Process, error) {
+	var execCmd string
+	var params []string
+
+	e := spec.Env
+	if l.osType == Windows {
+		execCmd = "powershell"
+		params = append(params, []string{"-ExecutionPolicy", "Bypass", "-F"}...)
+		if l.virtualized {
+			params = append(params, "run-sandbox.ps1")
+		} else {
+			params = append(params, "run-app.ps1")
+		}
+	} else {
+		execCmd = "./run-wine.sh"
+	}
+	params = append(params, e["apppath"], e["appfile"], e["appname"], e["hwkey"], e["screenwidth"], e["screenheight"], e["wineoptions"])
+	if l.osType == Windows {
+		params = append(params, "windows", "-vcodec", e["vcodec"])
+	} else {
+		params = append(params, spec.Name, e["videoport"], e["audioport"], e["inputport"], e["supervisorport"])
+		params = append(params, dockerRunArgs(spec)...)
+	}
+	l.log.Debug("Running the launch script", "cmd", execCmd, "args", params)
+
+	cmd := exec.Command(execCmd, params...)
+	cmd.Env = append(os.Environ(), "DOCKERHOST="+e["dockerhost"], "DISPLAYSIZE="+e["displaysize"], "VCODEC="+e["vcodec"])
+	p, err := startProcess(cmd, l.log)
+	if err != nil {
+		return nil, err
+	}
+	if l.osType == Windows {
+		// the script returns once the app is spawned, the app is only stopped by its image name
+		p.stop = l.windowsKill(e["appfile"])
+		p.cleanup = p.stop
+	} else {
+		// docker run -t doesn't forward the signals to the container
+		p.stop = []string{"docker", "stop", "-t", strconv.Itoa(dockerStopTimeout), spec.Name}
+		p.cleanup = []string{"docker", "rm", "-f", spec.Name}
+	}
+	return p, nil
+}
+
+// windowsKill returns the command killing the app spawned by the Windows scripts
+func (l *scriptLauncher) windowsKill(appfile string) []string {
+	if l.virtualized {
+		return []string{"taskkill", "/F", "/IM", "WindowsSandbox.exe", "/IM", "WindowsSandboxClient.exe"}
+	}
+	return []string{"taskkill", "/F", "/IM", appfile, "/IM", "ffmpeg.exe", "/IM", "syncinput.exe"}
+}
+
+// Exec runs the command in the container with the docker CLI
+func (l *scriptLauncher) Exec(name string, cmd []string) error {
+	if l.osType == Windows {
+		return fmt.Errorf("exec in %s: no container on Windows", name)
+	}
+	if out, err := exec.Command("docker", append([]string{"exec", name}, cmd...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("exec in %s: %v %s", name, err, out)
+	}
+	return nil
+}
+
+// PrepareNetwork creates the bridge network with the docker CLI
+func (l *scriptLauncher) PrepareNetwork(name string, internal bool) (string, error) {
+	if l.osType == Windows {
+		return "", fmt.Errorf("network %s: no container on Windows", name)
+	}
+	inspect := func() (string, error) {
+		out, err := exec.Command("docker", "network", "inspect", "--format", "{{range .IPAM.Config}}{{.Gateway}} {{end}}", name).Output()
+		if err != nil {
+			return "", err
+		}
+		return firstField(string(out)), nil
+	}
+	if gateway, err := inspect(); err == nil {
+		return gateway, nil
+	}
+
+	args := []string{"network", "create", "--driver", "bridge"}
+	if internal {
+		args = append(args, "--internal")
+	}
+	if out, err := exec.Command("docker", append(args, name)...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("create network %s: %v %s", name, err, out)
+	}
+	l.log.Info("Created the network", "network", name)
+	return inspect()
+}
+
+// dockerRunArgs returns the docker run flags confining the container of the spec
+func dockerRunArgs(spec LaunchSpec) []string {
+	var args []string
+	if spec.Privileged {
+		args = append(args, "--privileged")
+	}
+	for _, c := range spec.CapDrop {
+		args = append(args, "--cap-drop="+c)
+	}
+	for _, c := range spec.CapAdd {
+		args = append(args, "--cap-add="+c)
+	}
+	for _, o := range spec.SecurityOpt {
+		args = append(args, "--security-opt="+o)
+	}
+	if spec.NetworkMode != "" {
+		args = append(args, "--network="+spec.NetworkMode)
+	}
+	if r := spec.Resources; r.NanoCPUs > 0 {
+		args = append(args, fmt.Sprintf("--cpus=%.3f", float64(r.NanoCPUs)/1e9))
+	}
+	if r := spec.Resources; r.MemoryBytes > 0 {
+		args = append(args, fmt.Sprintf("--memory=%d", r.MemoryBytes))
+	}
+	if r := spec.Resources; r.PidsLimit > 0 {
+		args = append(args, fmt.Sprintf("--pids-limit=%d", r.PidsLimit))
+	}
+	for _, m := range spec.Mounts {
+		fields := []string{"type=" + m.Type, "source=" + m.Source, "target=" + m.Target}
+		if m.ReadOnly {
+			fields = append(fields, "readonly")
+		}
+		for k, v := range m.DriverOpts {
+			// --mount is CSV, quote the options containing commas
+			fields = append(fields, `"volume-opt=`+k+"="+v+`"`)
+		}
+		args = append(args, "--mount="+strings.Join(fields, ","))
+	}
+	for _, p := range spec.Ports {
+		host := strconv.Itoa(p.HostPort)
+		if p.HostIP != "" {
+			host = p.HostIP + ":" + host
+		}
+		args = append(args, fmt.Sprintf("--publish=%s:%d/%s", host, p.ContainerPort, p.Protocol))
+	}
+	return args
+}
+
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// Detached returns true if the script returns once the app is spawned
+func (l *scriptLauncher) Detached() bool {
+	// Windows scripts return once the app is spawned, run-wine.sh runs the container in foreground
+	return l.osType == Windows
+}
+
+// localProcess is a process started on the host
+type localProcess struct {
+	cmd *exec.Cmd
+	// stop is run on Stop to stop what the process spawned out of reach of its signals
+	stop []string
+	// cleanup is run after kill to remove what the process spawned
+	cleanup []string
+	log     *slog.Logger
+}
+
+// startProcess starts the command and forwards its output to the logger
+func startProcess(cmd *exec.Cmd, logger *slog.Logger) (*localProcess, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	go logOutput(stdout, logger)
+	go logOutput(stderr, logger)
+	if err := cmd.Start(); err != nil {
+		logger.Error("Cannot start the process", "cmd", cmd.Path, "err", err)
+		return nil, err
+	}
+	logger.Info("Started the process", "cmd", cmd.Path, "pid", cmd.Process.Pid)
+	return &localProcess{cmd: cmd, log: logger}, nil
+}
+
+func logOutput(r io.Reader, logger *slog.Logger) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		logger.Info(scanner.Text())
+	}
+}
+
+func (p *localProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+func (p *localProcess) Stop() error {
+	if len(p.stop) > 0 {
+		if out, err := exec.Command(p.stop[0], p.stop[1:]...).CombinedOutput(); err != nil {
+			p.log.Warn("Stop command failed", "cmd", p.stop, "err", err, "output", string(out))
+		}
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			// a detached script has returned already
+			return nil
+		}
+		// Windows doesn't support SIGTERM
+		return p.Kill()
+	}
+	return nil
+}
+
+func (p *localProcess) Kill() error {
+	err := p.cmd.Process.Kill()
+	if errors.Is(err, os.ErrProcessDone) {
+		err = nil
+	}
+	if len(p.cleanup) > 0 {
+		if cerr := exec.Command(p.cleanup[0], p.cleanup[1:]...).Run(); cerr != nil {
+			p.log.Warn("Cleanup command failed", "cmd", p.cleanup, "err", cerr)
+		}
+	}
+	return err
+}
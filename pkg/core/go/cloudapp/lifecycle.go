@@ -0,0 +1,318 @@
+package cloudapp
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+// AppState is the lifecycle state of an app process
+type AppState string
+
+const (
+	// AppStarting the process is launched, waiting for its first frame
+	AppStarting AppState = "starting"
+	// AppReady the app is streaming
+	AppReady AppState = "ready"
+	// AppDegraded the process is running but the stream stalls
+	AppDegraded AppState = "degraded"
+	// AppCrashed the process exited unexpectedly and waits for a restart
+	AppCrashed AppState = "crashed"
+	// AppStopped the process is stopped on purpose
+	AppStopped AppState = "stopped"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+	// stableUptime resets the backoff once the app runs this long
+	stableUptime = time.Minute
+	// staleStreamTimeout marks the app degraded when no frame comes in this long
+	staleStreamTimeout = 5 * time.Second
+	stopTimeout        = 10 * time.Second
+	healthInterval     = time.Second
+)
+
+// AppStatus is a snapshot of the app lifecycle
+type AppStatus struct {
+	Name      string    `json:"name"`
+	State     AppState  `json:"state"`
+	Since     time.Time `json:"since"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// appLifecycle keeps an app process running. It restarts the process with
+// exponential backoff when it exits and tracks stream health.
+type appLifecycle struct {
+	name string
+	// launch starts the app process
+	launch func() (Process, error)
+	// detached is true if the launched process returns once the app is spawned,
+	// the app health is then only judged by its stream
+	detached bool
+	// onStateChange is called on every transition, without lock held
+	onStateChange func(AppStatus)
+	log           *slog.Logger
+
+	lock       sync.Mutex
+	state      AppState
+	since      time.Time
+	restarts   int
+	lastError  string
+	proc       Process
+	startedAt  time.Time
+	lastPacket time.Time
+	// restart asks the supervisor loop to relaunch the process now
+	restart  chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newAppLifecycle(name string, launch func() (Process, error), detached bool, logger *slog.Logger) *appLifecycle {
+	return &appLifecycle{
+		name:     name,
+		launch:   launch,
+		detached: detached,
+		log:      logger,
+		state:    AppStopped,
+		since:    time.Now(),
+		restart:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Start supervises the app process in background
+func (l *appLifecycle) Start() {
+	go l.supervise()
+	go l.checkHealth()
+}
+
+// Restart kills the running process, the supervisor launches a new one
+func (l *appLifecycle) Restart() {
+	select {
+	case l.restart <- struct{}{}:
+	default:
+	}
+	l.lock.Lock()
+	proc := l.proc
+	l.lock.Unlock()
+	l.terminate(proc)
+}
+
+// Stop terminates the app process and waits for it to exit
+func (l *appLifecycle) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		l.lock.Lock()
+		proc := l.proc
+		l.lock.Unlock()
+		l.terminate(proc)
+		select {
+		case <-l.stopped:
+		case <-time.After(stopTimeout):
+			l.log.Warn("App did not stop in time, killing it", "timeout", stopTimeout)
+			if proc != nil {
+				proc.Kill()
+			}
+		}
+		l.setState(AppStopped, "")
+	})
+}
+
+// SetDetached changes how the next launched process is supervised
+func (l *appLifecycle) SetDetached(detached bool) {
+	l.lock.Lock()
+	l.detached = detached
+	l.lock.Unlock()
+}
+
+// OnPacket records the app is streaming
+func (l *appLifecycle) OnPacket() {
+	l.lock.Lock()
+	l.lastPacket = time.Now()
+	l.lock.Unlock()
+}
+
+// Status returns a snapshot of the lifecycle
+func (l *appLifecycle) Status() AppStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.status()
+}
+
+func (l *appLifecycle) status() AppStatus {
+	return AppStatus{
+		Name:      l.name,
+		State:     l.state,
+		Since:     l.since,
+		Restarts:  l.restarts,
+		LastError: l.lastError,
+	}
+}
+
+func (l *appLifecycle) setState(state AppState, lastError string) {
+	l.lock.Lock()
+	if l.state == state && lastError == "" {
+		l.lock.Unlock()
+		return
+	}
+	l.log.Info("App state changed", "from", l.state, "to", state, "err", lastError)
+	l.state = state
+	l.since = time.Now()
+	if lastError != "" {
+		l.lastError = lastError
+	}
+	status := l.status()
+	l.lock.Unlock()
+
+	if l.onStateChange != nil {
+		l.onStateChange(status)
+	}
+}
+
+func (l *appLifecycle) supervise() {
+	defer close(l.stopped)
+	backoff := minRestartBackoff
+
+	for {
+		l.setState(AppStarting, "")
+		proc, err := l.launch()
+		if err == nil {
+			l.lock.Lock()
+			stopping := l.isStopping()
+			if !stopping {
+				l.proc = proc
+				l.startedAt = time.Now()
+			}
+			l.lock.Unlock()
+			if stopping {
+				// Stop ran during the launch and found no process to stop
+				l.stopLaunched(proc)
+				return
+			}
+			err = proc.Wait()
+		}
+
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+
+		requested := false
+		select {
+		case <-l.restart:
+			requested = true
+		default:
+		}
+
+		l.lock.Lock()
+		detached := l.detached
+		l.lock.Unlock()
+		if err == nil && detached && !requested {
+			// the app lives on after the launcher, wait for an explicit restart
+			select {
+			case <-l.stop:
+				return
+			case <-l.restart:
+			}
+		} else if !requested {
+			l.lock.Lock()
+			uptime := time.Since(l.startedAt)
+			l.lock.Unlock()
+			if uptime >= stableUptime {
+				backoff = minRestartBackoff
+			}
+
+			msg := "exited"
+			if err != nil {
+				msg = err.Error()
+			}
+			l.setState(AppCrashed, msg)
+			l.log.Warn("App crashed, restarting", "backoff", backoff, "err", msg)
+			select {
+			case <-l.stop:
+				return
+			case <-l.restart:
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+		}
+
+		metrics.AppRestarts.WithLabelValues(l.name).Inc()
+		l.lock.Lock()
+		l.restarts++
+		l.proc = nil
+		l.lock.Unlock()
+	}
+}
+
+// checkHealth moves between ready and degraded according to the stream
+func (l *appLifecycle) checkHealth() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		l.lock.Lock()
+		state := l.state
+		streaming := !l.lastPacket.IsZero() && time.Since(l.lastPacket) < staleStreamTimeout
+		fresh := l.lastPacket.After(l.since)
+		l.lock.Unlock()
+
+		switch {
+		case (state == AppStarting || state == AppDegraded) && streaming && fresh:
+			l.setState(AppReady, "")
+		case state == AppReady && !streaming:
+			l.setState(AppDegraded, "no frame in "+staleStreamTimeout.String())
+		}
+	}
+}
+
+// isStopping returns true once Stop is called
+func (l *appLifecycle) isStopping() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopLaunched stops a process launched after Stop, it's killed if it doesn't exit in time
+func (l *appLifecycle) stopLaunched(proc Process) {
+	exited := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(exited)
+	}()
+	l.terminate(proc)
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		l.log.Warn("App did not stop in time, killing it", "timeout", stopTimeout)
+		proc.Kill()
+	}
+}
+
+// terminate asks the process to stop gracefully
+func (l *appLifecycle) terminate(proc Process) {
+	if proc == nil {
+		return
+	}
+	if err := proc.Stop(); err != nil {
+		l.log.Warn("Cannot stop the app", "err", err)
+	}
+}
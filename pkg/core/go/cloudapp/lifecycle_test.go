@@ -0,0 +1,87 @@
+package cloudapp
+
+import (
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProcess runs until it's stopped or killed
+type fakeProcess struct {
+	once   sync.Once
+	exited chan struct{}
+}
+
+func newFakeProcess() *fakeProcess {
+	return &fakeProcess{exited: make(chan struct{})}
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exited
+	return nil
+}
+
+func (p *fakeProcess) Stop() error {
+	p.once.Do(func() { close(p.exited) })
+	return nil
+}
+
+func (p *fakeProcess) Kill() error {
+	return p.Stop()
+}
+
+func (p *fakeProcess) isRunning() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func TestLifecycleStopDuringLaunch(t *testing.T) {
+	proc := newFakeProcess()
+	launching, launched := make(chan struct{}), make(chan struct{})
+	launch := func() (Process, error) {
+		close(launching)
+		<-launched
+		return proc, nil
+	}
+	l := newAppLifecycle("app", launch, false, slog.Default())
+	l.Start()
+	<-launching
+
+	stopped := make(chan struct{})
+	go func() {
+		l.Stop()
+		close(stopped)
+	}()
+	// the launch returns once Stop found no process
+	waitUntil(t, func() bool { return l.isStopping() })
+	close(launched)
+
+	select {
+	case <-l.stopped:
+	case <-time.After(stopTimeout):
+		t.Fatal("the supervisor is still running")
+	}
+	<-stopped
+	if proc.isRunning() {
+		t.Error("the process launched during Stop is still running")
+	}
+	if state := l.Status().State; state != AppStopped {
+		t.Errorf("state = %s, want %s", state, AppStopped)
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// ScaleMode is how the browser displays the app video in its element, as CSS object-fit
+type ScaleMode string
+
+const (
+	// ScaleFit shows the whole video, letterboxed (object-fit: contain). Default of a video element.
+	ScaleFit ScaleMode = "fit"
+	// ScaleFill covers the element, the video is cropped (object-fit: cover)
+	ScaleFill ScaleMode = "fill"
+	// ScaleStretch distorts the video to the element (object-fit: fill)
+	ScaleStretch ScaleMode = "stretch"
+	// ScaleNone shows the video at its size, centered (object-fit: none)
+	ScaleNone ScaleMode = "1:1"
+)
+
+// mousePayload is a mouse event in the coordinates of the video element
+type mousePayload struct {
+	IsLeft byte    `json:"isLeft"`
+	X      float32 `json:"x"`
+	Y      float32 `json:"y"`
+	Width  float32 `json:"width"`
+	Height float32 `json:"height"`
+	// Mode is the scale mode of the element. Default: fit
+	Mode ScaleMode `json:"mode"`
+}
+
+// rect is an area in pixels
+type rect struct {
+	X, Y, Width, Height float32
+}
+
+// screenMapper maps points of the video element to the app screen
+type screenMapper struct {
+	screenWidth  float32
+	screenHeight float32
+}
+
+// parseMousePayload decodes the mouse event and rejects sizes and points that cannot be mapped
+func parseMousePayload(jsonPayload string) (mousePayload, error) {
+	p := mousePayload{}
+	if err := json.Unmarshal([]byte(jsonPayload), &p); err != nil {
+		return p, err
+	}
+	if p.IsLeft > 1 {
+		return p, fmt.Errorf("invalid button %d", p.IsLeft)
+	}
+	if !isFinite(p.Width) || !isFinite(p.Height) || p.Width <= 0 || p.Height <= 0 {
+		return p, fmt.Errorf("invalid element size %vx%v", p.Width, p.Height)
+	}
+	if !isFinite(p.X) || !isFinite(p.Y) {
+		return p, fmt.Errorf("invalid point %v,%v", p.X, p.Y)
+	}
+	switch p.Mode {
+	case "":
+		p.Mode = ScaleFit
+	case ScaleFit, ScaleFill, ScaleStretch, ScaleNone:
+	default:
+		return p, fmt.Errorf("unknown scale mode %q", p.Mode)
+	}
+	return p, nil
+}
+
+// videoRect returns where the video is displayed in an element of the size
+func (m screenMapper) videoRect(width, height float32, mode ScaleMode) rect {
+	switch mode {
+	case ScaleStretch:
+		return rect{0, 0, width, height}
+	case ScaleNone:
+		return rect{(width - m.screenWidth) / 2, (height - m.screenHeight) / 2, m.screenWidth, m.screenHeight}
+	}
+
+	scaleX, scaleY := width/m.screenWidth, height/m.screenHeight
+	scale := float32(math.Min(float64(scaleX), float64(scaleY)))
+	if mode == ScaleFill {
+		scale = float32(math.Max(float64(scaleX), float64(scaleY)))
+	}
+	w, h := m.screenWidth*scale, m.screenHeight*scale
+	return rect{(width - w) / 2, (height - h) / 2, w, h}
+}
+
+// Map returns the screen point of the element point. Points outside the video,
+// ex. on the letterbox bars, are clamped to the screen edge.
+func (m screenMapper) Map(p mousePayload) (float32, float32) {
+	video := m.videoRect(p.Width, p.Height, p.Mode)
+	x := (p.X - video.X) * m.screenWidth / video.Width
+	y := (p.Y - video.Y) * m.screenHeight / video.Height
+	return clamp(x, 0, m.screenWidth-1), clamp(y, 0, m.screenHeight-1)
+}
+
+func clamp(v float32, min float32, max float32) float32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func isFinite(v float32) bool {
+	return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+}
@@ -0,0 +1,85 @@
+package cloudapp
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScreenMapperMap(t *testing.T) {
+	m := screenMapper{screenWidth: 800, screenHeight: 600}
+	tests := []struct {
+		name         string
+		p            mousePayload
+		wantX, wantY float32
+	}{
+		// 1600x900 shows the video at 1200x900 with 200px bars on the sides
+		{"fit center", mousePayload{X: 800, Y: 450, Width: 1600, Height: 900, Mode: ScaleFit}, 400, 300},
+		{"fit video corner", mousePayload{X: 200, Y: 0, Width: 1600, Height: 900, Mode: ScaleFit}, 0, 0},
+		{"fit left bar", mousePayload{X: 100, Y: 450, Width: 1600, Height: 900, Mode: ScaleFit}, 0, 300},
+		{"fit right bar", mousePayload{X: 1500, Y: 450, Width: 1600, Height: 900, Mode: ScaleFit}, 799, 300},
+		// 800x1200 shows the video at 800x600 with 300px bars on top and bottom
+		{"fit top bar", mousePayload{X: 400, Y: 100, Width: 800, Height: 1200, Mode: ScaleFit}, 400, 0},
+		{"fit bottom bar", mousePayload{X: 400, Y: 1100, Width: 800, Height: 1200, Mode: ScaleFit}, 400, 599},
+		{"fit video top", mousePayload{X: 400, Y: 300, Width: 800, Height: 1200, Mode: ScaleFit}, 400, 0},
+		// 1600x900 shows the video at 1600x1200, 150px are cropped on top and bottom
+		{"fill center", mousePayload{X: 800, Y: 450, Width: 1600, Height: 900, Mode: ScaleFill}, 400, 300},
+		{"fill corner", mousePayload{X: 0, Y: 0, Width: 1600, Height: 900, Mode: ScaleFill}, 0, 75},
+		{"fill opposite corner", mousePayload{X: 1600, Y: 900, Width: 1600, Height: 900, Mode: ScaleFill}, 799, 525},
+		{"stretch", mousePayload{X: 200, Y: 150, Width: 400, Height: 300, Mode: ScaleStretch}, 400, 300},
+		{"stretch distorted", mousePayload{X: 100, Y: 150, Width: 200, Height: 600, Mode: ScaleStretch}, 400, 150},
+		{"stretch edge", mousePayload{X: 400, Y: 300, Width: 400, Height: 300, Mode: ScaleStretch}, 799, 599},
+		// 1000x800 shows the video at its size with 100px around
+		{"1:1 center", mousePayload{X: 500, Y: 400, Width: 1000, Height: 800, Mode: ScaleNone}, 400, 300},
+		{"1:1 video corner", mousePayload{X: 100, Y: 100, Width: 1000, Height: 800, Mode: ScaleNone}, 0, 0},
+		{"1:1 outside", mousePayload{X: 50, Y: 750, Width: 1000, Height: 800, Mode: ScaleNone}, 0, 599},
+		// a smaller element crops the video
+		{"1:1 cropped", mousePayload{X: 0, Y: 0, Width: 400, Height: 300, Mode: ScaleNone}, 200, 150},
+		{"negative point", mousePayload{X: -50, Y: -50, Width: 800, Height: 600, Mode: ScaleFit}, 0, 0},
+	}
+	for _, tt := range tests {
+		x, y := m.Map(tt.p)
+		if !near(x, tt.wantX) || !near(y, tt.wantY) {
+			t.Errorf("%s: Map(%+v) = %v,%v, want %v,%v", tt.name, tt.p, x, y, tt.wantX, tt.wantY)
+		}
+	}
+}
+
+func TestParseMousePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    mousePayload
+		wantErr bool
+	}{
+		{"default mode", `{"isLeft":1,"x":10,"y":20,"width":800,"height":600}`,
+			mousePayload{IsLeft: 1, X: 10, Y: 20, Width: 800, Height: 600, Mode: ScaleFit}, false},
+		{"fill", `{"x":10,"y":20,"width":800,"height":600,"mode":"fill"}`,
+			mousePayload{X: 10, Y: 20, Width: 800, Height: 600, Mode: ScaleFill}, false},
+		{"1:1", `{"x":10,"y":20,"width":800,"height":600,"mode":"1:1"}`,
+			mousePayload{X: 10, Y: 20, Width: 800, Height: 600, Mode: ScaleNone}, false},
+		{"not json", `x=10`, mousePayload{}, true},
+		{"wrong type", `{"x":"10","y":20,"width":800,"height":600}`, mousePayload{}, true},
+		{"invalid button", `{"isLeft":2,"x":10,"y":20,"width":800,"height":600}`, mousePayload{}, true},
+		{"missing size", `{"x":10,"y":20}`, mousePayload{}, true},
+		{"zero width", `{"x":10,"y":20,"width":0,"height":600}`, mousePayload{}, true},
+		{"negative height", `{"x":10,"y":20,"width":800,"height":-600}`, mousePayload{}, true},
+		{"overflowing point", `{"x":1e39,"y":20,"width":800,"height":600}`, mousePayload{}, true},
+		{"unknown mode", `{"x":10,"y":20,"width":800,"height":600,"mode":"zoom"}`, mousePayload{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMousePayload(tt.payload)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseMousePayload(%s) = %+v, want an error", tt.name, tt.payload, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: parseMousePayload(%s) = %+v %v, want %+v", tt.name, tt.payload, got, err, tt.want)
+		}
+	}
+}
+
+func near(a, b float32) bool {
+	return math.Abs(float64(a-b)) < 0.01
+}
@@ -0,0 +1,392 @@
+package cloudapp
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+var errPoolClosed = errors.New("app pool is closed")
+
+// maxLaunchFailures is the number of launches in a row which may fail before the
+// waiting clients are turned down. Launches are retried after a backoff meanwhile.
+const maxLaunchFailures = 3
+
+// firstPacketTimeout bounds the wait for the streams of a launched instance
+const firstPacketTimeout = 2 * time.Minute
+
+// instance is a dedicated app instance of a user in ondemand mode
+type instance struct {
+	addr   string
+	slot   int
+	app    *ccImpl
+	events chan Packet
+	// owner is the user holding the instance
+	owner string
+	// numClients is the number of connections of the owner using the instance
+	numClients int
+	// clients are the attached connections the instance streams to
+	clients map[*Client]bool
+	// release tears down the instance after the grace period
+	release *time.Timer
+}
+
+// appModeHandler manages app instances. In ondemand mode it keeps a pool of
+// pre-warmed instances and assigns one to each user.
+type appModeHandler struct {
+	appMode            string
+	cfg                config.Config
+	availableInstances []*instance
+	assignedInstances  map[string]*instance
+	// usedSlots are the port slots taken by launched instances, from slotBase
+	slotBase     int
+	usedSlots    map[int]bool
+	numLaunching int
+	// closed stops launching and assigning instances, done is closed with it
+	closed bool
+	done   chan struct{}
+	// launchFailures are the launches failed in a row, no instance is launched before retryAt
+	launchFailures int
+	retryAt        time.Time
+	// onResize is called when the instance of owner is resized
+	onResize func(owner string, width, height int)
+	log      *slog.Logger
+
+	lock sync.Mutex
+	// instanceReady is signaled when an instance is available or freed
+	instanceReady *sync.Cond
+}
+
+func NewAppMode(appMode string) *appModeHandler {
+	return newAppModeHandler(config.Config{AppMode: appMode})
+}
+
+func newAppModeHandler(cfg config.Config) *appModeHandler {
+	h := &appModeHandler{
+		appMode:           cfg.AppMode,
+		cfg:               cfg,
+		assignedInstances: map[string]*instance{},
+		usedSlots:         map[int]bool{},
+		done:              make(chan struct{}),
+		log:               slog.Default(),
+	}
+	h.instanceReady = sync.NewCond(&h.lock)
+	return h
+}
+
+// Prewarm launches idle instances up to the configured pool size
+func (h *appModeHandler) Prewarm() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fill()
+}
+
+// Acquire returns the instance of the owner, assigns an idle one or waits for a free one.
+// It returns nil once the pool is closed, cancel is closed or the launches keep failing.
+func (h *appModeHandler) Acquire(owner string, cancel <-chan struct{}) *instance {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			// wake up the wait below
+			h.lock.Lock()
+			h.instanceReady.Broadcast()
+			h.lock.Unlock()
+		case <-stop:
+		}
+	}()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	defer close(stop)
+
+	for {
+		if h.closed {
+			return nil
+		}
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+		if inst, ok := h.assignedInstances[owner]; ok {
+			// the owner is back within grace period or opens another connection
+			if inst.release != nil {
+				inst.release.Stop()
+				inst.release = nil
+			}
+			inst.numClients++
+			return inst
+		}
+		if len(h.availableInstances) > 0 {
+			inst := h.availableInstances[0]
+			h.availableInstances = h.availableInstances[1:]
+			inst.owner = owner
+			inst.numClients = 1
+			h.assignedInstances[owner] = inst
+			h.log.Info("Assigned an app instance", logging.KeyInstance, inst.app.ports.container, "owner", owner)
+			h.fill()
+			return inst
+		}
+		if h.numLaunching == 0 && h.numInstances() < h.cfg.OnDemand.MaxInstances {
+			if h.launchFailures >= maxLaunchFailures && time.Now().Before(h.retryAt) {
+				h.log.Warn("App instances fail to launch, turning down the client", "owner", owner, "failures", h.launchFailures)
+				return nil
+			}
+			if !time.Now().Before(h.retryAt) {
+				h.launch()
+			}
+		}
+		h.log.Info("Waiting for a free app instance", "owner", owner)
+		h.instanceReady.Wait()
+	}
+}
+
+// Attach streams the instance to the acquired client. If the client is already gone,
+// the instance is released and it returns false.
+func (h *appModeHandler) Attach(inst *instance, client *Client) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	select {
+	case <-client.cancel:
+		h.release(client.userID)
+		return false
+	default:
+	}
+	inst.clients[client] = true
+	return true
+}
+
+// Detach stops streaming to the client and releases the instance
+func (h *appModeHandler) Detach(inst *instance, client *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(inst.clients, client)
+	h.release(client.userID)
+}
+
+// clientsOf returns the clients attached to the instance
+func (h *appModeHandler) clientsOf(inst *instance) []*Client {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	clients := make([]*Client, 0, len(inst.clients))
+	for client := range inst.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// stream fans out the streams of the instance to its clients until it's closed
+func (h *appModeHandler) stream(inst *instance) {
+	for {
+		select {
+		case <-inst.app.done:
+			return
+		case p := <-inst.app.VideoStream():
+			offerPacket(h.clientsOf(inst), p, metrics.StreamVideo, videoStreamOf)
+		case p := <-inst.app.AudioStream():
+			offerPacket(h.clientsOf(inst), p, metrics.StreamAudio, audioStreamOf)
+		}
+	}
+}
+
+// release gives back the instance of the owner. It is torn down after the grace period.
+// Must be called with lock held.
+func (h *appModeHandler) release(owner string) {
+	inst, ok := h.assignedInstances[owner]
+	if !ok {
+		return
+	}
+	inst.numClients--
+	if inst.numClients > 0 {
+		return
+	}
+
+	grace := time.Duration(h.cfg.OnDemand.GracePeriod) * time.Second
+	h.log.Info("Releasing the app instance", logging.KeyInstance, inst.app.ports.container, "owner", owner, "grace", grace)
+	inst.release = time.AfterFunc(grace, func() { h.teardown(inst) })
+}
+
+// fill launches instances until there are enough idle ones. Must be called with lock held.
+func (h *appModeHandler) fill() {
+	for !h.closed && !time.Now().Before(h.retryAt) && len(h.availableInstances)+h.numLaunching < h.cfg.OnDemand.PrewarmInstances &&
+		h.numInstances() < h.cfg.OnDemand.MaxInstances {
+		h.launch()
+	}
+}
+
+func (h *appModeHandler) numInstances() int {
+	return len(h.availableInstances) + len(h.assignedInstances) + h.numLaunching
+}
+
+// launch spawns a new instance in background. Must be called with lock held.
+func (h *appModeHandler) launch() {
+	slot := h.slotBase
+	for h.usedSlots[slot] {
+		slot++
+	}
+	h.usedSlots[slot] = true
+	h.numLaunching++
+	cfg := h.cfg
+
+	go func() {
+		events := make(chan Packet, 1)
+		// an instance which doesn't stream in time or once the pool closes is given up
+		abort, launched := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(abort)
+			timeout := time.NewTimer(firstPacketTimeout)
+			defer timeout.Stop()
+			select {
+			case <-launched:
+			case <-h.done:
+			case <-timeout.C:
+				h.log.Warn("App instance did not stream in time", "slot", slot, "timeout", firstPacketTimeout)
+			}
+		}()
+		app, err := newCloudAppClient(cfg, events, newAppPorts(slot), nil, h.log, abort)
+		close(launched)
+
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.numLaunching--
+		if h.closed {
+			// the pool is closed while launching
+			if err == nil {
+				go app.Close()
+			}
+			err = errPoolClosed
+		}
+		if err != nil {
+			delete(h.usedSlots, slot)
+			if err != errPoolClosed {
+				h.launchFailed(slot, err)
+			}
+			h.instanceReady.Broadcast()
+			return
+		}
+		h.launchFailures = 0
+		inst := &instance{
+			addr:    cfg.InstanceAddr,
+			slot:    slot,
+			app:     app,
+			events:  events,
+			clients: map[*Client]bool{},
+		}
+		app.onResize = func(width, height int) {
+			h.lock.Lock()
+			owner, onResize := inst.owner, h.onResize
+			h.lock.Unlock()
+			if owner != "" && onResize != nil {
+				onResize(owner, width, height)
+			}
+		}
+		go app.Handle()
+		go h.stream(inst)
+
+		h.availableInstances = append(h.availableInstances, inst)
+		app.log.Info("App instance is ready", "slot", slot)
+		h.instanceReady.Broadcast()
+	}()
+}
+
+// launchFailed delays the next launch with an exponential backoff, the waiting
+// clients are woken up once it can be retried. Must be called with lock held.
+func (h *appModeHandler) launchFailed(slot int, err error) {
+	h.launchFailures++
+	backoff := minRestartBackoff << uint(h.launchFailures-1)
+	if backoff > maxRestartBackoff || backoff <= 0 {
+		backoff = maxRestartBackoff
+	}
+	h.retryAt = time.Now().Add(backoff)
+	h.log.Error("Cannot launch an app instance", "slot", slot, "failures", h.launchFailures, "retry_in", backoff, "err", err)
+	time.AfterFunc(backoff, func() {
+		h.lock.Lock()
+		h.fill()
+		h.instanceReady.Broadcast()
+		h.lock.Unlock()
+	})
+}
+
+func (h *appModeHandler) teardown(inst *instance) {
+	h.lock.Lock()
+	if inst.numClients > 0 || h.assignedInstances[inst.owner] != inst {
+		// reacquired meanwhile
+		h.lock.Unlock()
+		return
+	}
+	delete(h.assignedInstances, inst.owner)
+	h.lock.Unlock()
+
+	inst.app.log.Info("Tearing down the app instance", "owner", inst.owner)
+	// the events are never closed, the input of a client may still be sent
+	inst.app.Close()
+
+	h.lock.Lock()
+	delete(h.usedSlots, inst.slot)
+	h.fill()
+	h.instanceReady.Broadcast()
+	h.lock.Unlock()
+}
+
+// Statuses returns the lifecycle of every launched instance
+func (h *appModeHandler) Statuses() []AppStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	statuses := []AppStatus{}
+	for _, inst := range h.availableInstances {
+		statuses = append(statuses, inst.app.Status())
+	}
+	for _, inst := range h.assignedInstances {
+		statuses = append(statuses, inst.app.Status())
+	}
+	return statuses
+}
+
+// Close tears down all instances
+func (h *appModeHandler) Close() {
+	h.lock.Lock()
+	instances := append([]*instance{}, h.availableInstances...)
+	for _, inst := range h.assignedInstances {
+		if inst.release != nil {
+			inst.release.Stop()
+		}
+		instances = append(instances, inst)
+	}
+	h.availableInstances = nil
+	h.assignedInstances = map[string]*instance{}
+	if !h.closed {
+		// abort the launches waiting for their streams
+		close(h.done)
+	}
+	h.closed = true
+	// wake up clients waiting for an instance
+	h.instanceReady.Broadcast()
+	h.lock.Unlock()
+
+	for _, inst := range instances {
+		inst.app.Close()
+	}
+}
+
+// attachInstance streams the instance to the client and sends the client input to the instance.
+// The instance is released when the client is cancelled. It returns false if the client is already gone
+// or the pool is closed.
+func (s *Service) attachInstance(client *Client, inst *instance) bool {
+	if inst == nil {
+		return false
+	}
+	client.setEvents(inst.events)
+	if !s.appModeHandler.Attach(inst, client) {
+		return false
+	}
+	go func() {
+		<-client.cancel
+		s.appModeHandler.Detach(inst, client)
+	}()
+	return true
+}
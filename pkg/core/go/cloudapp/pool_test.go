@@ -0,0 +1,47 @@
+package cloudapp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+func TestAcquireGivesUpOnFailingLaunches(t *testing.T) {
+	cfg := config.Config{
+		AppMode:  OnDemandMode,
+		Launcher: config.LauncherConfig{Type: "missing"},
+		OnDemand: config.OnDemandConfig{MaxInstances: 1},
+	}
+	h := newAppModeHandler(cfg)
+	h.slotBase = 500
+	defer h.Close()
+
+	start := time.Now()
+	if inst := h.Acquire("user", nil); inst != nil {
+		t.Fatal("acquired an instance which failed to launch")
+	}
+	h.lock.Lock()
+	failures, retryAt := h.launchFailures, h.retryAt
+	h.lock.Unlock()
+	if failures != maxLaunchFailures {
+		t.Errorf("launch failures = %d, want %d", failures, maxLaunchFailures)
+	}
+	// the launches are retried after 1s then 2s, not in a loop
+	if elapsed := time.Since(start); elapsed < 3*minRestartBackoff {
+		t.Errorf("gave up after %v, the launches are not backed off", elapsed)
+	}
+
+	// a client coming during the backoff is turned down at once
+	if !time.Now().Before(retryAt) {
+		t.Fatal("no backoff after the last failure")
+	}
+	if inst := h.Acquire("other", nil); inst != nil {
+		t.Fatal("acquired an instance during the backoff")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.launchFailures != maxLaunchFailures || h.numLaunching != 0 {
+		t.Errorf("failures = %d, launching = %d, launched during the backoff", h.launchFailures, h.numLaunching)
+	}
+}
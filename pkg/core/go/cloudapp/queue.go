@@ -0,0 +1,175 @@
+package cloudapp
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+const (
+	roleViewer = "viewer"
+	rolePlayer = "player"
+)
+
+// clientCleanupTimeout bounds the wait for a client stream to stop
+const clientCleanupTimeout = 2 * time.Second
+
+// The methods below must be called with clientsLock held
+
+// isFull returns true if there is no slot left for a new client
+func (s *Service) isFull() bool {
+	return s.maxClients > 0 && len(s.clients) >= s.maxClients
+}
+
+// admit gives the client a slot and sends the 1st packet to start WebRTC
+func (s *Service) admit(client *Client) {
+	s.clients[client.clientID] = client
+	client.admittedAt = time.Now()
+	if !client.viewOnly && (s.maxPlayers == 0 || s.numPlayers() < s.maxPlayers) {
+		client.setPlayer(true)
+	}
+	client.log.Info("Admitted the client", "role", client.role())
+
+	if s.isOnDemand() {
+		// launching an instance takes a while, don't hold the lock
+		go func() {
+			inst := s.appModeHandler.Acquire(client.userID, client.cancel)
+			if inst == nil {
+				s.turnDown(client)
+				return
+			}
+			if s.attachInstance(client, inst) {
+				client.start()
+				client.sendScreenSize(inst.app)
+			}
+		}()
+		return
+	}
+	client.start()
+	if app, ok := s.ccApp.(*ccImpl); ok {
+		client.sendScreenSize(app)
+	}
+}
+
+// turnDown closes a client which got no app instance, unless it's gone or the service is shutting down
+func (s *Service) turnDown(client *Client) {
+	select {
+	case <-client.cancel:
+		return
+	case <-s.done:
+		return
+	default:
+	}
+	client.log.Warn("No app instance for the client, closing it")
+	client.send(cws.WSPacket{Type: "SHUTDOWN"})
+	s.RemoveClient(client.clientID)
+	client.socket().Close()
+}
+
+// start lets the client begin WebRTC negotiation
+func (c *Client) start() {
+	close(c.admitted)
+	// The 1st packet
+	c.send(cws.WSPacket{Type: "init", Data: c.webrtcConf.BrowserICEServers()})
+	c.send(cws.WSPacket{Type: "ROLE", Data: c.role()})
+}
+
+// sendScreenSize tells the client the current screen size of the app, it may be resized by players
+func (c *Client) sendScreenSize(app *ccImpl) {
+	width, height := app.screenSize()
+	c.send(newScreenSizePacket(int(width), int(height), app.resizeBounds()))
+}
+
+// admitWaiting fills free slots from the waiting queue
+func (s *Service) admitWaiting() {
+	for len(s.waiting) > 0 && !s.isFull() && !s.isClosed() {
+		client := s.waiting[0]
+		s.waiting = s.waiting[1:]
+		s.admit(client)
+	}
+	s.promoteViewers()
+	s.updateQueuePositions()
+}
+
+// promoteViewers turns the longest admitted viewers into players when player slots are free
+func (s *Service) promoteViewers() {
+	for s.maxPlayers > 0 && s.numPlayers() < s.maxPlayers {
+		var next *Client
+		for _, client := range s.clients {
+			if client.IsPlayer() || client.viewOnly {
+				continue
+			}
+			if next == nil || client.admittedAt.Before(next.admittedAt) {
+				next = client
+			}
+		}
+		if next == nil {
+			return
+		}
+		next.setPlayer(true)
+		next.log.Info("Promoted the client to player")
+		next.send(cws.WSPacket{Type: "ROLE", Data: rolePlayer})
+	}
+}
+
+// removeWaiting removes the client from the waiting queue, it returns nil if the client isn't waiting
+func (s *Service) removeWaiting(clientID string) *Client {
+	for i, client := range s.waiting {
+		if client.clientID == clientID {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return client
+		}
+	}
+	return nil
+}
+
+func (s *Service) updateQueuePositions() {
+	for i, client := range s.waiting {
+		client.sendQueuePosition(i + 1)
+	}
+}
+
+func (s *Service) numPlayers() int {
+	n := 0
+	for _, client := range s.clients {
+		if client.IsPlayer() {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Client) sendQueuePosition(position int) {
+	c.send(cws.WSPacket{Type: "QUEUE", Data: strconv.Itoa(position)})
+}
+
+func (c *Client) isAdmitted() bool {
+	select {
+	case <-c.admitted:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsPlayer returns true if the client input is forwarded to the app
+func (c *Client) IsPlayer() bool {
+	return atomic.LoadInt32(&c.isPlayer) == 1
+}
+
+func (c *Client) setPlayer(isPlayer bool) {
+	var v int32
+	if isPlayer {
+		v = 1
+	}
+	atomic.StoreInt32(&c.isPlayer, v)
+}
+
+func (c *Client) role() string {
+	if c.IsPlayer() {
+		return rolePlayer
+	}
+	return roleViewer
+}
@@ -0,0 +1,44 @@
+package cloudapp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket of a client input. It allows bursts of one second worth of events.
+// It is used by the input loop of the client only.
+type rateLimiter struct {
+	// rate is events per second shared by the service, 0 is unlimited
+	rate   *int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate *int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// Allow returns true if the event is within the rate
+func (l *rateLimiter) Allow() bool {
+	rate := float64(atomic.LoadInt64(l.rate))
+	if rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,133 @@
+package cloudapp
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// liveFields are applied to new clients and peers without restart
+var liveFields = map[string]bool{
+	"pageTitle":           true,
+	"appName":             true,
+	"hasChat":             true,
+	"stunturn":            true,
+	"iceServers":          true,
+	"nat1to1ip":           true,
+	"disableInterceptors": true,
+	"maxClients":          true,
+	"maxPlayers":          true,
+	"idle":                true,
+	"inputRateLimit":      true,
+	"reconnectGrace":      true,
+	"restartOnReload":     true,
+}
+
+// appFields are applied when the app restarts. Other fields need a server restart.
+var appFields = map[string]bool{
+	"path":         true,
+	"appFile":      true,
+	"windowTitle":  true,
+	"hardwareKey":  true,
+	"screenWidth":  true,
+	"screenHeight": true,
+	"isWindowMode": true,
+	"resize":       true,
+	"launcher":     true,
+	"sandbox":      true,
+	"virtualize":   true,
+	// the encoder of the app must switch with the track of the peers
+	"videoCodec": true,
+}
+
+// ReloadReport lists the config fields changed by a reload
+type ReloadReport struct {
+	// Applied are live for new clients and peers
+	Applied []string `json:"applied"`
+	// AppRestart are applied once the app restarts
+	AppRestart []string `json:"app_restart"`
+	// ServerRestart are ignored until the server restarts
+	ServerRestart []string `json:"server_restart"`
+	// Restarted is true if the app is restarted to apply AppRestart fields
+	Restarted bool `json:"restarted"`
+}
+
+// Changed returns true if the reload changed any field
+func (r ReloadReport) Changed() bool {
+	return len(r.Applied)+len(r.AppRestart)+len(r.ServerRestart) > 0
+}
+
+// Reload applies the live fields of cfg. App fields are applied by restarting the
+// app if restartOnReload is set, ondemand instances launched from now on use them.
+func (s *Service) Reload(cfg config.Config) ReloadReport {
+	current := s.getConfig()
+	report := ReloadReport{}
+	for _, key := range config.Diff(current, cfg) {
+		switch {
+		case liveFields[key]:
+			report.Applied = append(report.Applied, key)
+		case appFields[key]:
+			report.AppRestart = append(report.AppRestart, key)
+		default:
+			report.ServerRestart = append(report.ServerRestart, key)
+		}
+	}
+	if !report.Changed() {
+		return report
+	}
+
+	// the running config keeps what is not applied, so it is reported again on next reload
+	running := cfg
+	copyFields(&running, current, report.ServerRestart)
+	if len(report.AppRestart) > 0 {
+		if s.isOnDemand() {
+			s.appModeHandler.setConfig(running)
+		} else if app, ok := s.ccApp.(*ccImpl); ok && cfg.RestartOnReload {
+			if err := app.Reconfigure(running); err != nil {
+				s.log.Error("Cannot restart the app with the new config", "err", err)
+				copyFields(&running, current, report.AppRestart)
+			} else {
+				report.Restarted = true
+			}
+		} else {
+			copyFields(&running, current, report.AppRestart)
+		}
+	}
+
+	s.confLock.Lock()
+	s.config = running
+	s.webrtcConf = newWebRTCConfig(running, s.relay)
+	s.confLock.Unlock()
+	atomic.StoreInt64(&s.inputRate, int64(running.InputRateLimit))
+
+	s.clientsLock.Lock()
+	s.setCapacity(running)
+	s.admitWaiting()
+	s.clientsLock.Unlock()
+
+	s.log.Info("Reloaded the config", "applied", report.Applied, "app_restart", report.AppRestart,
+		"restarted", report.Restarted, "server_restart", report.ServerRestart)
+	return report
+}
+
+// copyFields copies the top level fields with the yaml keys from src to dst
+func copyFields(dst *config.Config, src config.Config, keys []string) {
+	d, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	t := d.Type()
+	for _, key := range keys {
+		for i := 0; i < t.NumField(); i++ {
+			if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] == key {
+				d.Field(i).Set(sv.Field(i))
+			}
+		}
+	}
+}
+
+// setConfig changes the config of instances launched from now on
+func (h *appModeHandler) setConfig(cfg config.Config) {
+	h.lock.Lock()
+	h.cfg = cfg
+	h.lock.Unlock()
+}
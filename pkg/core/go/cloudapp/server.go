@@ -2,21 +2,23 @@
 package cloudapp
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
 	"text/template"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/auth"
 	"github.com/giongto35/cloud-morph/pkg/common/config"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{}
-
 type initData struct {
 	CurAppID string `json:"cur_app_id"`
 	// App maynot be inside Apps because App can be in local, not in discovery
@@ -30,8 +32,24 @@ type Server struct {
 	appID      string
 	httpServer *http.Server
 	wsClients  map[string]*cws.Client
-	capp       *Service
-	appMeta    config.AppDiscoveryMeta
+	// apps of the catalog, the first one is the default app served at /ws
+	apps     []*hostedApp
+	appsByID map[string]*hostedApp
+	metaLock sync.Mutex
+	auth     *auth.Authenticator
+	upgrader websocket.Upgrader
+	// relay is the embedded TURN server shared by the apps, nil if off
+	relay *turnRelay
+	// done is closed when all apps are shut down
+	done chan struct{}
+}
+
+// hostedApp is an app of the catalog with its own service, ports and launcher
+type hostedApp struct {
+	id   string
+	capp *Service
+	// meta is guarded by Server.metaLock
+	meta config.AppDiscoveryMeta
 }
 
 func NewServer(cfg config.Config) *Server {
@@ -45,20 +63,41 @@ func NewServer(cfg config.Config) *Server {
 }
 
 func NewServerWithHTTPServerMux(cfg config.Config, r *mux.Router, svmux *http.ServeMux) *Server {
-	server := &Server{}
+	authenticator := auth.NewFromConfig(cfg.Auth)
+	server := &Server{
+		appsByID: map[string]*hostedApp{},
+		auth:     authenticator,
+		// be aware of ReadBufferSize, WriteBufferSize (default 4096)
+		upgrader: websocket.Upgrader{CheckOrigin: authenticator.CheckOrigin},
+		done:     make(chan struct{}),
+	}
 
+	embed := func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := template.ParseFiles(embedPage)
+		if err != nil {
+			slog.Error("Cannot parse the embed page", "page", embedPage, "err", err)
+			http.Error(w, "embed page is not available", http.StatusInternalServerError)
+			return
+		}
+
+		tmpl.Execute(w, nil)
+	}
 	r.HandleFunc("/ws", server.WS)
-	r.HandleFunc("/embed",
-		func(w http.ResponseWriter, r *http.Request) {
-			tmpl, err := template.ParseFiles(embedPage)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			tmpl.Execute(w, nil)
-		},
-	)
-	fmt.Println("handler", r)
+	r.HandleFunc("/ws/{appID}", server.WS)
+	r.HandleFunc("/whep", server.WHEP)
+	r.HandleFunc("/whep/{appID}", server.WHEP)
+	r.HandleFunc("/whip", server.WHIP)
+	r.HandleFunc("/whip/{appID}", server.WHIP)
+	r.HandleFunc("/whep/session/{sessionID}/{secret}", server.PeerSession)
+	r.HandleFunc("/whip/session/{sessionID}/{secret}", server.PeerSession)
+	r.HandleFunc("/status", server.StatusHandler)
+	r.HandleFunc("/status/{appID}", server.StatusHandler)
+	r.HandleFunc("/latency", server.LatencyHandler)
+	r.HandleFunc("/latency/{appID}", server.LatencyHandler)
+	r.HandleFunc("/stats", server.StatsHandler)
+	r.HandleFunc("/stats/{appID}", server.StatsHandler)
+	r.HandleFunc("/embed", embed)
+	r.HandleFunc("/embed/{appID}", embed)
 
 	httpServer := &http.Server{
 		Addr:         addr,
@@ -67,9 +106,44 @@ func NewServerWithHTTPServerMux(cfg config.Config, r *mux.Router, svmux *http.Se
 		IdleTimeout:  120 * time.Second,
 		Handler:      svmux,
 	}
-	log.Println("Embedded server")
-	server.capp = NewCloudService(cfg)
-	appMeta := config.AppDiscoveryMeta{
+	slog.Debug("Embedded server")
+	var relayICE *webrtc.ICEServer
+	if cfg.TURN.Enabled {
+		relay, err := newTURNRelay(cfg.TURN, cfg.InstanceAddr)
+		if err != nil {
+			panic(err)
+		}
+		server.relay = relay
+		relayICE = &relay.ice
+	}
+	// each app takes its own range of port slots
+	slotBase := 0
+	for _, app := range cfg.Catalog() {
+		slog.Info("Hosting the app", logging.KeyApp, app.ID, "name", app.Config.AppName, "slot", slotBase)
+		hosted := &hostedApp{
+			id:   app.ID,
+			capp: newCloudService(app.ID, app.Config, slotBase, relayICE),
+			meta: newAppMeta(app.ID, app.Config),
+		}
+		server.apps = append(server.apps, hosted)
+		server.appsByID[app.ID] = hosted
+		slotBase += app.Config.NumSlots()
+	}
+	server.httpServer = httpServer
+
+	go func() {
+		for _, app := range server.apps {
+			<-app.capp.Done()
+		}
+		close(server.done)
+	}()
+
+	return server
+}
+
+func newAppMeta(appID string, cfg config.Config) config.AppDiscoveryMeta {
+	return config.AppDiscoveryMeta{
+		AppID:        appID,
 		Addr:         cfg.InstanceAddr,
 		AppName:      cfg.AppName,
 		AppMode:      cfg.AppMode,
@@ -78,66 +152,153 @@ func NewServerWithHTTPServerMux(cfg config.Config, r *mux.Router, svmux *http.Se
 		ScreenWidth:  cfg.ScreenWidth,
 		ScreenHeight: cfg.ScreenHeight,
 	}
-	server.httpServer = httpServer
-	server.appMeta = appMeta
+}
 
-	return server
+// Reload applies the new config to every app, see Service.Reload.
+// Fields of catalog apps are reported as apps.{id}.{field}.
+func (s *Server) Reload(cfg config.Config) ReloadReport {
+	report := ReloadReport{}
+	catalog := cfg.Catalog()
+	seen := map[string]bool{}
+	for _, app := range catalog {
+		hosted, ok := s.appsByID[app.ID]
+		if !ok {
+			continue
+		}
+		seen[app.ID] = true
+		r := hosted.capp.Reload(app.Config)
+		prefix := ""
+		if app.ID != "" {
+			prefix = "apps." + app.ID + "."
+		}
+		report.Applied = append(report.Applied, prefixed(prefix, r.Applied)...)
+		report.AppRestart = append(report.AppRestart, prefixed(prefix, r.AppRestart)...)
+		report.ServerRestart = append(report.ServerRestart, prefixed(prefix, r.ServerRestart)...)
+		report.Restarted = report.Restarted || r.Restarted
+
+		s.metaLock.Lock()
+		hosted.meta = newAppMeta(app.ID, hosted.capp.getConfig())
+		s.metaLock.Unlock()
+	}
+	if len(seen) != len(catalog) || len(seen) != len(s.apps) {
+		// apps are added or removed
+		report.ServerRestart = append(report.ServerRestart, "apps")
+	}
+	return report
+}
+
+func prefixed(prefix string, keys []string) []string {
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = prefix + k
+	}
+	return out
+}
+
+// Apps returns the meta of the hosted apps, the default app first
+func (s *Server) Apps() []config.AppDiscoveryMeta {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	metas := make([]config.AppDiscoveryMeta, len(s.apps))
+	for i, app := range s.apps {
+		metas[i] = app.meta
+	}
+	return metas
+}
+
+// appOf returns the app requested by the {appID} route, or the default app
+func (s *Server) appOf(r *http.Request) (*hostedApp, bool) {
+	appID, ok := mux.Vars(r)["appID"]
+	if !ok {
+		return s.apps[0], true
+	}
+	app, ok := s.appsByID[appID]
+	return app, ok
 }
 
 func (o *Server) Handle() {
 	// Spawn CloudGaming Handle
-	go o.capp.Handle()
+	for _, app := range o.apps {
+		go app.capp.Handle()
+	}
 }
 
 func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
-	log.Println("A user is connecting...")
+	slog.Debug("A user is connecting")
 	// defer func() {
 	// 	if r := recover(); r != nil {
 	// 		log.Println("Warn: Something wrong. Recovered in ", r)
 	// 	}
 	// }()
 
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		// TODO: can we be stricter?
-		return true
+	app, ok := s.appOf(r)
+	if !ok {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	if app.capp.isClosed() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	claims, err := s.auth.Authenticate(r)
+	if err != nil {
+		app.capp.log.Warn("Refused a websocket", "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
 	}
-	// be aware of ReadBufferSize, WriteBufferSize (default 4096)
+	if claims.AppID != "" && claims.AppID != app.id {
+		app.capp.log.Warn("Refused a websocket with the token of another app", "token_app", claims.AppID)
+		http.Error(w, "token is not valid for this app", http.StatusForbidden)
+		return
+	}
+	if claims.Subject != "" {
+		app.capp.log.Info("Authenticated the user", "user", claims.Subject)
+	}
+
 	// https://pkg.go.dev/github.com/gorilla/websocket?tab=doc#Upgrader
-	c, err := upgrader.Upgrade(w, r, nil)
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Coordinator: [!] WS upgrade:", err)
+		app.capp.log.Warn("Cannot upgrade the websocket", "err", err)
 		return
 	}
 
 	// Create websocket Client
 	wsClient := cws.NewClient(c)
-	clientID := wsClient.GetID()
 	// TODO: Update packet
-	// Add websocket client to app service
-	serviceClient := s.capp.AddClient(clientID, wsClient)
+	// A dropped browser resumes its client, otherwise add websocket client to app service
+	query := r.URL.Query()
+	serviceClient := app.capp.ResumeClient(query.Get("session"), claims.Subject, query.Get("peer") == "1", wsClient)
+	if serviceClient == nil {
+		serviceClient = app.capp.AddClient(wsClient.GetID(), claims.Subject, wsClient)
+	}
+	clientID := serviceClient.clientID
 	serviceClient.Route()
-	log.Println("Initialized ServiceClient")
+	serviceClient.log.Info("Initialized the client")
 
-	s.initClientData(wsClient)
+	s.initClientData(wsClient, app)
 	go func(browserClient *cws.Client) {
 		browserClient.Listen()
-		log.Println("Closing connection")
+		browserClient.Logger().Debug("Closing the connection")
 		browserClient.Close()
-		s.capp.RemoveClient(clientID)
-		log.Println("Closed connection")
+		// the client keeps its seat for a while to reconnect
+		app.capp.DisconnectClient(clientID, browserClient)
+		browserClient.Logger().Info("Closed the connection")
 	}(wsClient)
 }
 
-func (s *Server) initClientData(client *cws.Client) {
+func (s *Server) initClientData(client *cws.Client, app *hostedApp) {
+	s.metaLock.Lock()
 	data := initData{
 		CurAppID: s.appID,
-		App:      s.appMeta,
+		App:      app.meta,
 	}
+	s.metaLock.Unlock()
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return
 	}
-	fmt.Println("Send Client INIT")
+	client.Logger().Debug("Sending INIT")
 	client.Send(cws.WSPacket{
 		Type: "INIT",
 		Data: string(jsonData),
@@ -145,9 +306,72 @@ func (s *Server) initClientData(client *cws.Client) {
 }
 
 func (o *Server) ListenAndServe() error {
-	log.Println("Server is running at", addr)
+	slog.Info("Server is running", "addr", addr)
 	return o.httpServer.ListenAndServe()
 }
 
-func (o *Server) Shutdown() {
+// StatusHandler returns the app lifecycle and client counts as JSON
+func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.appOf(r)
+	if !ok {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.capp.Status())
+}
+
+// LatencyHandler returns the latency report of each client of the app as JSON
+func (s *Server) LatencyHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.appOf(r)
+	if !ok {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.capp.LatencyReports())
+}
+
+// StatsHandler returns the stream quality of each client of the app as JSON
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.appOf(r)
+	if !ok {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.capp.ClientStats())
+}
+
+// Done is closed when all apps are shut down, ex. after being idle
+func (o *Server) Done() chan struct{} {
+	return o.done
+}
+
+// Shutdown stops accepting clients, closes them and the apps, then stops the
+// HTTP server once its requests are done. It returns once ctx expires, the apps
+// may still be shutting down then.
+func (o *Server) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, app := range o.apps {
+		wg.Add(1)
+		go func(capp *Service) {
+			defer wg.Done()
+			capp.Shutdown()
+		}(app.capp)
+	}
+	appsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(appsDone)
+	}()
+	select {
+	case <-appsDone:
+	case <-ctx.Done():
+		slog.Warn("Apps did not shut down in time", "err", ctx.Err())
+	}
+	if o.relay != nil {
+		o.relay.Close()
+	}
+	return o.httpServer.Shutdown(ctx)
 }
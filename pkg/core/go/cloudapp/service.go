@@ -2,13 +2,16 @@ package cloudapp
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/giongto35/cloud-morph/pkg/common/config"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	"github.com/gofrs/uuid"
 	"github.com/pion/rtp"
 )
 
@@ -20,29 +23,77 @@ const (
 )
 
 type Service struct {
-	clients        map[string]*Client
+	clients map[string]*Client
+	// sessions indexes the admitted and waiting clients by session ID
+	sessions map[string]*Client
+	// waiting holds clients queued for a free slot, in FIFO order
+	waiting        []*Client
+	clientsLock    sync.Mutex
+	maxClients     int
+	maxPlayers     int
 	appModeHandler *appModeHandler
 	ccApp          CloudAppClient
-	config         config.Config
+	// config and webrtcConf are replaced on reload
+	confLock   sync.RWMutex
+	config     config.Config
+	webrtcConf *webrtc.Config
 	// chat           *textchat.TextChat Not using own chat
 	// communicate with cloud app
-	appEvents  chan Packet
-	webrtcConf *webrtc.Config
+	appEvents chan Packet
+	activity  *activityTracker
+	// inputRate is the shared input rate limit of the players
+	inputRate int64
+	// relay is the embedded TURN server advertised to the clients, nil if off
+	relay *webrtc.ICEServer
+	// done is closed when the service is shut down
+	done     chan struct{}
+	doneOnce sync.Once
+	log      *slog.Logger
 }
 
 type Client struct {
-	clientID    string
-	ws          *cws.Client
-	rtcConn     *webrtc.WebRTC
+	clientID string
+	// userID owns the app instance in ondemand mode. Default to clientID
+	userID string
+	// sessionID lets the browser resume the client on a new websocket
+	sessionID string
+	// wsLock guards ws, it's replaced when the client resumes
+	wsLock sync.Mutex
+	ws     *cws.Client
+	// rtcLock guards rtcConn and inputPeer, the peer is replaced on a new initwebrtc
+	rtcLock sync.Mutex
+	rtcConn *webrtc.WebRTC
+	// inputPeer is the peer whose input is forwarded
+	inputPeer   *webrtc.WebRTC
+	handleOnce  sync.Once
 	videoStream chan *rtp.Packet
 	audioStream chan *rtp.Packet
-	appEvents   chan Packet
+	// eventsLock guards appEvents, it's set to the instance of the user in ondemand mode
+	eventsLock sync.Mutex
+	appEvents  chan Packet
 	// videoTrack   *webrtc.Track
 	// cancel to trigger cleaning up when client is disconnected
 	cancel chan struct{}
 	// done to notify if the client is done clean up
 	done       chan struct{}
 	webrtcConf *webrtc.Config
+	// admitted is closed when the client gets a slot
+	admitted   chan struct{}
+	admittedAt time.Time
+	// isPlayer is 1 if the client input is forwarded to the app
+	isPlayer int32
+	// viewOnly clients are never players, ex. WHEP players
+	viewOnly bool
+	// peerSecret authorizes the session resource of a client signaled over HTTP
+	peerSecret string
+	activity   *activityTracker
+	limiter    *rateLimiter
+	latency    *latencyTracker
+	stats      *statsTracker
+	// grace removes the client if it doesn't resume in time. Guarded by clientsLock.
+	grace *time.Timer
+	// log has the app, client and session of the client
+	log *slog.Logger
 }
 
 type AppHost struct {
@@ -51,21 +102,6 @@ type AppHost struct {
 	AppName string `json:"app_name"`
 }
 
-type instance struct {
-	addr string
-}
-
-type appModeHandler struct {
-	appMode            string
-	availableInstances []instance
-}
-
-func NewAppMode(appMode string) *appModeHandler {
-	return &appModeHandler{
-		appMode: appMode,
-	}
-}
-
 // Heartbeat maintains connection to server
 func (c *Client) Heartbeat() {
 	// send heartbeat every 1s
@@ -74,7 +110,7 @@ func (c *Client) Heartbeat() {
 	for range timer {
 		select {
 		case <-c.cancel:
-			log.Println("Close heartbeat")
+			c.log.Debug("Close heartbeat")
 			return
 		default:
 		}
@@ -82,156 +118,405 @@ func (c *Client) Heartbeat() {
 	}
 }
 
-func (s *Service) AddClient(clientID string, ws *cws.Client) *Client {
-	client := NewServiceClient(clientID, ws, s.appEvents, s.webrtcConf)
-	s.clients[clientID] = client
+// AddClient admits the client if there is a free slot, otherwise puts it in the waiting queue
+func (s *Service) AddClient(clientID string, userID string, ws *cws.Client) *Client {
+	client := s.newClient(clientID, userID, ws)
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	if s.isClosed() {
+		// the client is never admitted
+		ws.Send(cws.WSPacket{Type: "SHUTDOWN"}, nil)
+		return client
+	}
+	s.activity.Join()
+	s.sessions[client.sessionID] = client
+	client.send(cws.WSPacket{Type: "SESSION", Data: client.sessionID})
+	if s.isFull() {
+		s.waiting = append(s.waiting, client)
+		client.log.Info("Server is full, queued the client", "position", len(s.waiting))
+		client.sendQueuePosition(len(s.waiting))
+		return client
+	}
+	s.admit(client)
+	return client
+}
+
+// newClient returns a client of the user, userID defaults to clientID
+func (s *Service) newClient(clientID string, userID string, ws *cws.Client) *Client {
+	if userID == "" {
+		userID = clientID
+	}
+	s.confLock.RLock()
+	// TURN credentials are issued to the user
+	client := NewServiceClient(clientID, ws, s.appEvents, s.webrtcConf.ForUser(userID))
+	s.confLock.RUnlock()
+	client.userID = userID
+	client.activity = s.activity
+	client.limiter = newRateLimiter(&s.inputRate)
+	client.log = s.log.With(logging.KeyClient, clientID, logging.KeySession, client.sessionID)
+	if ws != nil {
+		ws.SetLogger(client.log)
+	}
 	return client
 }
 
+// RemoveClient cleans up the client and hands its slot to the next waiting client
 func (s *Service) RemoveClient(clientID string) {
-	client := s.clients[clientID]
+	s.clientsLock.Lock()
+	if client := s.removeWaiting(clientID); client != nil {
+		s.forgetSession(client)
+		s.updateQueuePositions()
+		s.clientsLock.Unlock()
+		s.activity.Leave()
+		return
+	}
+	client, ok := s.clients[clientID]
+	if ok {
+		// only the first of the concurrent removals cleans up the client
+		delete(s.clients, clientID)
+		s.forgetSession(client)
+	}
+	s.clientsLock.Unlock()
+	if !ok {
+		return
+	}
+	s.activity.Leave()
+
 	close(client.cancel)
-	<-client.done
-	if client.rtcConn != nil {
-		client.rtcConn.StopClient()
-		client.rtcConn = nil
+	select {
+	case <-client.done:
+	case <-time.After(clientCleanupTimeout):
+		// Handle is never started if the peer didn't answer
+	}
+	if peer := client.setPeer(nil); peer != nil {
+		peer.StopClient()
 	}
+	s.clientsLock.Lock()
+	s.admitWaiting()
+	s.clientsLock.Unlock()
 }
 
 func NewServiceClient(clientID string, ws *cws.Client, appEvents chan Packet, conf *webrtc.Config) *Client {
-	// The 1st packet
-	ws.Send(cws.WSPacket{Type: "init", Data: conf.GetStun()}, nil)
-
+	sessionID := uuid.Must(uuid.NewV4()).String()
 	return &Client{
 		appEvents:   appEvents,
 		clientID:    clientID,
+		sessionID:   sessionID,
 		ws:          ws,
 		videoStream: make(chan *rtp.Packet, 100),
 		audioStream: make(chan *rtp.Packet, 100),
 		cancel:      make(chan struct{}),
 		done:        make(chan struct{}),
 		webrtcConf:  conf,
+		admitted:    make(chan struct{}),
+		latency:     &latencyTracker{},
+		stats:       &statsTracker{},
+		log:         slog.Default().With(logging.KeyClient, clientID, logging.KeySession, sessionID),
 	}
 }
 
 func (c *Client) Handle() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered when sent to close Image Channel")
-		}
-	}()
-
 	wg := sync.WaitGroup{}
 
 	// Video Stream
 	wg.Add(1)
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Println("Recovered. Maybe we :sent to Closed Channel", r)
-				wg.Done()
-			}
-		}()
-
-	loop:
-		for packet := range c.videoStream {
-			select {
-			case <-c.cancel:
-				break loop
-			case c.rtcConn.ImageChannel <- packet:
-			}
-		}
+		c.forward(c.videoStream, metrics.StreamVideo, func(peer *webrtc.WebRTC) chan *rtp.Packet { return peer.ImageChannel })
 		wg.Done()
-		log.Println("Closed Service Video Channel")
+		c.log.Debug("Closed the video stream")
 	}()
 
 	// Audio Stream
 	wg.Add(1)
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Println("Recovered. Maybe we :sent to Closed Channel", r)
-				wg.Done()
-			}
-		}()
-
-	loop:
-		for packet := range c.audioStream {
-			select {
-			case <-c.cancel:
-				break loop
-			case c.rtcConn.AudioChannel <- packet:
-			}
-		}
+		c.forward(c.audioStream, metrics.StreamAudio, func(peer *webrtc.WebRTC) chan *rtp.Packet { return peer.AudioChannel })
 		wg.Done()
-		log.Println("Closed Service Audio Channel")
+		c.log.Debug("Closed the audio stream")
 	}()
+	wg.Wait()
+	close(c.done)
+}
 
-	// Input stream is closed after StopClient . TODO: check if can close earlier
-	// wg.Add(1)
-	go func() {
-		// Data channel input
-		for rawInput := range c.rtcConn.InputChannel {
-			// TODO: No dynamic allocation
-			wspacket := cws.WSPacket{}
-			err := json.Unmarshal(rawInput, &wspacket)
-			if err != nil {
-				log.Println(err)
+// forward streams the packets of in until the client is cancelled or in is closed
+func (c *Client) forward(in chan *rtp.Packet, stream string, channel func(*webrtc.WebRTC) chan *rtp.Packet) {
+	for {
+		select {
+		case <-c.cancel:
+			return
+		case packet, ok := <-in:
+			if !ok || !c.stream(packet, stream, channel) {
+				return
 			}
-			c.appEvents <- convertWSPacket(wspacket)
 		}
-		// wg.Done()
-	}()
-	wg.Wait()
-	close(c.done)
+	}
+}
+
+// fanOut offers the packet to the stream of each client
+func (s *Service) fanOut(p *rtp.Packet, stream string, clientStream func(*Client) chan *rtp.Packet) {
+	s.clientsLock.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.clientsLock.Unlock()
+	offerPacket(clients, p, stream, clientStream)
+}
+
+// offerPacket sends the packet to the stream of each client. A client not keeping up
+// drops the packet rather than stalling the others.
+func offerPacket(clients []*Client, p *rtp.Packet, stream string, clientStream func(*Client) chan *rtp.Packet) {
+	for _, client := range clients {
+		select {
+		case clientStream(client) <- p:
+		default:
+			metrics.RTPPacketsDropped.WithLabelValues(stream).Inc()
+		}
+	}
+}
+
+func videoStreamOf(c *Client) chan *rtp.Packet { return c.videoStream }
+
+func audioStreamOf(c *Client) chan *rtp.Packet { return c.audioStream }
+
+// events returns the channel of the input to the app
+func (c *Client) events() chan Packet {
+	c.eventsLock.Lock()
+	defer c.eventsLock.Unlock()
+	return c.appEvents
+}
+
+func (c *Client) setEvents(events chan Packet) {
+	c.eventsLock.Lock()
+	c.appEvents = events
+	c.eventsLock.Unlock()
+}
+
+// stream sends the packet to the channel of the current peer. The packet is dropped
+// while there is no peer or it's stopped. It returns false once the client is cancelled.
+func (c *Client) stream(packet *rtp.Packet, stream string, channel func(*webrtc.WebRTC) chan *rtp.Packet) bool {
+	peer := c.peer()
+	if peer == nil {
+		metrics.RTPPacketsDropped.WithLabelValues(stream).Inc()
+		return true
+	}
+	select {
+	case <-c.cancel:
+		return false
+	case <-peer.Done():
+		// a new peer may replace it
+		metrics.RTPPacketsDropped.WithLabelValues(stream).Inc()
+	case channel(peer) <- packet:
+	}
+	return true
+}
+
+// forwardInput sends the data channel input of the peer to the app until the peer is stopped.
+// Each channel has its own path: keys and clicks are never dropped, moves are dropped
+// while the app lags behind and control messages are handled by the service.
+func (c *Client) forwardInput(peer *webrtc.WebRTC) {
+	for {
+		select {
+		case <-peer.Done():
+			return
+		case rawInput := <-peer.InputChannel:
+			if packet, ok := c.inputPacket(rawInput); ok {
+				select {
+				case c.events() <- packet:
+				case <-peer.Done():
+					return
+				}
+			}
+		case rawInput := <-peer.MotionChannel:
+			if packet, ok := c.inputPacket(rawInput); ok {
+				select {
+				case c.events() <- packet:
+				default:
+					// the next move supersedes it
+				}
+			}
+		case rawControl := <-peer.ControlChannel:
+			c.handleControl(rawControl)
+		}
+	}
+}
+
+// inputPacket decodes the input of a player, it returns false if the input is dropped
+func (c *Client) inputPacket(rawInput []byte) (Packet, bool) {
+	if !c.IsPlayer() {
+		// viewers only watch
+		return Packet{}, false
+	}
+	if !c.limiter.Allow() {
+		return Packet{}, false
+	}
+	c.activity.Input()
+	// TODO: No dynamic allocation
+	wspacket := cws.WSPacket{}
+	err := json.Unmarshal(rawInput, &wspacket)
+	if err != nil {
+		c.log.Warn("Cannot decode the input", "err", err)
+		return Packet{}, false
+	}
+	packet := convertWSPacket(wspacket)
+	packet.received = time.Now()
+	packet.onDispatch = c.latency.dispatched
+	return packet, true
+}
+
+// handleControl handles a message of the control channel
+func (c *Client) handleControl(rawControl []byte) {
+	packet := cws.WSPacket{}
+	if err := json.Unmarshal(rawControl, &packet); err != nil {
+		c.log.Warn("Cannot decode the control message", "err", err)
+		return
+	}
+	switch packet.Type {
+	case eventResize:
+		c.requestResize(packet.Data)
+	case eventPong:
+		if err := c.latency.pong(packet.Data); err != nil {
+			c.log.Warn("Invalid pong", "err", err)
+		}
+	default:
+		c.log.Warn("Unknown control message", "type", packet.Type)
+	}
+}
+
+// requestResize asks the app to change its screen size
+func (c *Client) requestResize(data string) {
+	if !c.isAdmitted() || !c.IsPlayer() {
+		// viewers watch the size chosen by players
+		return
+	}
+	c.log.Info("Received a resize request", "size", data)
+	select {
+	case c.events() <- Packet{Type: eventResize, Data: data}:
+	case <-c.cancel:
+	}
+}
+
+// startPeer streams to the negotiated peer and forwards its input.
+// An ICE restart negotiates the same peer again.
+func (c *Client) startPeer(peer *webrtc.WebRTC) {
+	c.rtcLock.Lock()
+	newPeer := c.inputPeer != peer
+	c.inputPeer = peer
+	c.rtcLock.Unlock()
+	if newPeer {
+		go c.forwardInput(peer)
+		go c.probeLatency(peer)
+		go c.collectStats(peer)
+	}
+	c.handleOnce.Do(func() { go c.Handle() })
 }
 
 func (c *Client) Route() {
+	ws := c.socket()
 	// Listen from video stream
 	// WebRTC
-	c.ws.Receive("initwebrtc", func(req cws.WSPacket) (resp cws.WSPacket) {
-		log.Println("Received a request to createOffer from browser", req)
+	ws.Receive("initwebrtc", func(req cws.WSPacket) (resp cws.WSPacket) {
+		c.log.Debug("Received a request to create an offer")
+		if !c.isAdmitted() {
+			c.log.Info("Client is still waiting for a slot")
+			return cws.EmptyPacket
+		}
 
-		c.rtcConn = webrtc.NewWebRTC()
+		peer := c.newPeer()
+		peer.OnICERestart = c.restartICE
+		if old := c.setPeer(peer); old != nil {
+			// the browser starts over
+			old.StopClient()
+		}
 
-		localSession, err := c.rtcConn.StartClient(
+		localSession, err := peer.StartClient(
 			func(candidate string) {
 				// send back candidate string to browser
-				c.ws.Send(cws.WSPacket{Type: "candidate", Data: candidate, SessionID: req.SessionID}, nil)
+				c.send(cws.WSPacket{Type: "candidate", Data: candidate, SessionID: req.SessionID})
 			},
 			c.webrtcConf,
 		)
 
 		if err != nil {
-			log.Println("Error: Cannot create new webrtc session", err)
+			c.log.Error("Cannot create the WebRTC session", "err", err)
 			return cws.EmptyPacket
 		}
 
 		return cws.WSPacket{Type: "offer", Data: localSession}
 	})
 
-	c.ws.Receive(
+	// A client may offer instead, the server answers and the candidates trickle both ways
+	ws.Receive("offer", func(req cws.WSPacket) (resp cws.WSPacket) {
+		c.log.Debug("Received an offer")
+		if !c.isAdmitted() {
+			c.log.Info("Client is still waiting for a slot")
+			return cws.EmptyPacket
+		}
+		offer, err := webrtc.DecodeSDP(req.Data)
+		if err != nil {
+			c.log.Warn("Cannot decode the offer", "err", err)
+			return cws.EmptyPacket
+		}
+
+		peer := c.newPeer()
+		peer.OnICERestart = c.restartICE
+		if old := c.setPeer(peer); old != nil {
+			old.StopClient()
+		}
+		answer, err := peer.AnswerClient(offer, c.webrtcConf, func(candidate string) {
+			c.send(cws.WSPacket{Type: "candidate", Data: candidate, SessionID: req.SessionID})
+		})
+		if err == nil {
+			answer, err = webrtc.EncodeAnswer(answer)
+		}
+		if err != nil {
+			c.log.Warn("Cannot answer the offer", "err", err)
+			return cws.EmptyPacket
+		}
+		c.startPeer(peer)
+		return cws.WSPacket{Type: "answer", Data: answer}
+	})
+
+	ws.Receive("iceRestart", func(req cws.WSPacket) (resp cws.WSPacket) {
+		c.log.Info("Received an ICE restart request")
+		c.restartICE()
+		return cws.EmptyPacket
+	})
+
+	ws.Receive(eventResize, func(req cws.WSPacket) (resp cws.WSPacket) {
+		c.requestResize(req.Data)
+		return cws.EmptyPacket
+	})
+
+	ws.Receive(
 		"answer",
 		func(resp cws.WSPacket) (req cws.WSPacket) {
-			log.Println("Received answer SDP from browser", resp)
-			err := c.rtcConn.SetRemoteSDP(resp.Data)
+			c.log.Debug("Received an answer")
+			peer := c.peer()
+			if peer == nil {
+				return cws.EmptyPacket
+			}
+			err := peer.SetRemoteSDP(resp.Data)
 			if err != nil {
-				log.Println("Error: Cannot set RemoteSDP of client: " + resp.SessionID)
+				c.log.Warn("Cannot set the answer", "err", err)
 			}
 
-			go c.Handle()
+			c.startPeer(peer)
 			return cws.EmptyPacket
 		},
 	)
 
-	c.ws.Receive(
+	ws.Receive(
 		"candidate",
 		func(resp cws.WSPacket) (req cws.WSPacket) {
-			log.Println("Received remote Ice Candidate from browser")
+			peer := c.peer()
+			if peer == nil {
+				return cws.EmptyPacket
+			}
 
-			err := c.rtcConn.AddCandidate(resp.Data)
+			err := peer.AddCandidate(resp.Data)
 			if err != nil {
-				log.Println("Error: Cannot add IceCandidate of client: " + resp.SessionID)
+				c.log.Warn("Cannot add the candidate", "err", err)
 			}
 
 			return cws.EmptyPacket
@@ -241,69 +526,249 @@ func (c *Client) Route() {
 
 // NewCloudService returns a Cloud Service
 func NewCloudService(conf config.Config) *Service {
+	return newCloudService(conf.AppName, conf, 0, nil)
+}
+
+// newCloudService returns a Cloud Service whose app instances take the port slots from slotBase.
+// relay is the embedded TURN server, if any. appID is the app in the log lines.
+func newCloudService(appID string, conf config.Config, slotBase int, relay *webrtc.ICEServer) *Service {
 	appEvents := make(chan Packet, 1)
 
-	webrtcConf := &webrtc.DefaultConfig
+	appModeHandler := newAppModeHandler(conf)
+	appModeHandler.slotBase = slotBase
+	s := &Service{
+		clients:        map[string]*Client{},
+		sessions:       map[string]*Client{},
+		appEvents:      appEvents,
+		appModeHandler: appModeHandler,
+		config:         conf,
+		webrtcConf:     newWebRTCConfig(conf, relay),
+		relay:          relay,
+		activity:       newActivityTracker(),
+		inputRate:      int64(conf.InputRateLimit),
+		done:           make(chan struct{}),
+		log:            slog.Default().With(logging.KeyApp, appID),
+	}
+	s.setCapacity(conf)
+	appModeHandler.onResize = s.sendScreenSize
+	appModeHandler.log = s.log
+
+	if !s.isOnDemand() {
+		app, err := newCloudAppClient(conf, appEvents, newAppPorts(slotBase), s.broadcastAppStatus, s.log, nil)
+		if err != nil {
+			panic(err)
+		}
+		app.onResize = func(width, height int) { s.sendScreenSize("", width, height) }
+		s.ccApp = app
+	}
+
+	return s
+}
+
+// newWebRTCConfig returns the peer config of the app, the relay is added to the ICE servers
+func newWebRTCConfig(conf config.Config, relay *webrtc.ICEServer) *webrtc.Config {
+	webrtcConf := webrtc.DefaultConfig
 	webrtcConf.Override(
 		webrtc.Codec(conf.VideoCodec),
 		webrtc.DisableInterceptors(conf.DisableInterceptors),
 		webrtc.Nat1to1(conf.NAT1To1IP),
 		webrtc.StunServer(conf.StunTurn),
+		webrtc.ICEServers(newICEServers(conf.ICEServers)),
 	)
+	if relay != nil {
+		webrtcConf.ICEServers = append(append([]webrtc.ICEServer{}, webrtcConf.ICEServers...), *relay)
+	}
+	return &webrtcConf
+}
 
-	s := &Service{
-		clients:        map[string]*Client{},
-		appEvents:      appEvents,
-		appModeHandler: NewAppMode(conf.AppMode),
-		ccApp:          NewCloudAppClient(conf, appEvents),
-		config:         conf,
-		webrtcConf:     webrtcConf,
+func newICEServers(servers []config.ICEServerConfig) []webrtc.ICEServer {
+	ice := make([]webrtc.ICEServer, 0, len(servers))
+	for _, s := range servers {
+		server := webrtc.ICEServer{Secret: s.Secret, TTL: time.Duration(s.TTL) * time.Second}
+		server.URLs, server.Username, server.Credential = s.URLs, s.Username, s.Credential
+		ice = append(ice, server)
 	}
+	return ice
+}
 
-	return s
+// setCapacity sets the client limits. Must be called with clientsLock held once running.
+func (s *Service) setCapacity(conf config.Config) {
+	s.maxClients = conf.MaxClients
+	s.maxPlayers = conf.MaxPlayers
+	if s.isOnDemand() {
+		// Each user plays on a dedicated instance, the pool bounds the number of clients
+		if s.maxClients == 0 || s.maxClients > conf.OnDemand.MaxInstances {
+			s.maxClients = conf.OnDemand.MaxInstances
+		}
+		s.maxPlayers = 0
+	}
+}
+
+func (s *Service) getConfig() config.Config {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.config
+}
+
+func (s *Service) isOnDemand() bool {
+	return s.appModeHandler.appMode == OnDemandMode
 }
 
 func (s *Service) SendInput(packet Packet) {
+	if s.ccApp == nil {
+		// ondemand instances receive input from their own client
+		return
+	}
 	s.ccApp.SendInput(packet)
 }
 
+// ServiceStatus reports the app processes and the clients of the service
+type ServiceStatus struct {
+	AppMode    string      `json:"app_mode"`
+	Apps       []AppStatus `json:"apps"`
+	NumClients int         `json:"num_clients"`
+	NumWaiting int         `json:"num_waiting"`
+}
+
+// Status returns the current status of the service
+func (s *Service) Status() ServiceStatus {
+	status := ServiceStatus{AppMode: s.appModeHandler.appMode}
+	if app, ok := s.ccApp.(*ccImpl); ok {
+		status.Apps = []AppStatus{app.Status()}
+	} else {
+		status.Apps = s.appModeHandler.Statuses()
+	}
+	s.clientsLock.Lock()
+	status.NumClients = len(s.clients)
+	status.NumWaiting = len(s.waiting)
+	s.clientsLock.Unlock()
+	return status
+}
+
+// broadcastAppStatus tells clients the app is restarting or back
+func (s *Service) broadcastAppStatus(status AppStatus) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	s.broadcast(cws.WSPacket{Type: "APPSTATUS", Data: string(data)})
+	// clients signaled over HTTP have no websocket
+	s.Push("", messageAppStatus, status)
+}
+
+// messageAppStatus pushes AppStatus over the data channel
+var messageAppStatus = webrtc.RegisterMessage("APPSTATUS", AppStatus{}, false)
+
+// Push sends the message over the data channel to the clients of the user, all clients if userID is empty
+func (s *Service) Push(userID string, t webrtc.MessageType, payload interface{}) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	for _, client := range s.clients {
+		if userID == "" || client.userID == userID {
+			client.push(t, payload)
+		}
+	}
+}
+
+// sendScreenSize tells the clients of the user the new screen size, all clients if userID is empty
+func (s *Service) sendScreenSize(userID string, width, height int) {
+	packet := newScreenSizePacket(width, height, s.getConfig().Resize)
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	for _, client := range s.clients {
+		if userID == "" || client.userID == userID {
+			client.send(packet)
+		}
+	}
+}
+
+// screenBounds are the sizes players may resize the screen to
+type screenBounds struct {
+	MinWidth  int `json:"minWidth"`
+	MinHeight int `json:"minHeight"`
+	MaxWidth  int `json:"maxWidth"`
+	MaxHeight int `json:"maxHeight"`
+}
+
+// newScreenSizePacket returns the screen size, with the resize bounds if players may resize it
+func newScreenSizePacket(width, height int, resize config.ResizeConfig) cws.WSPacket {
+	var bounds *screenBounds
+	if resize.Enabled() {
+		bounds = &screenBounds{resize.MinWidth, resize.MinHeight, resize.MaxWidth, resize.MaxHeight}
+	}
+	data, _ := json.Marshal(struct {
+		Width  int           `json:"width"`
+		Height int           `json:"height"`
+		Resize *screenBounds `json:"resize,omitempty"`
+	}{width, height, bounds})
+	return cws.WSPacket{Type: eventResize, Data: string(data)}
+}
+
+// Done is closed when the service is shut down
+func (s *Service) Done() chan struct{} {
+	return s.done
+}
+
+func (s *Service) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown tells the clients the service is going away, closes their peer
+// connections and stops the app instances
+func (s *Service) Shutdown() {
+	s.doneOnce.Do(func() {
+		// no client is admitted from now on
+		s.clientsLock.Lock()
+		close(s.done)
+		clients := append([]*Client{}, s.waiting...)
+		for _, client := range s.clients {
+			clients = append(clients, client)
+		}
+		s.clientsLock.Unlock()
+
+		s.log.Info("Shutting down the service", "clients", len(clients))
+		// a removal may wait for the client to clean up, don't add up the waits
+		var wg sync.WaitGroup
+		for _, client := range clients {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				client.send(cws.WSPacket{Type: "SHUTDOWN"})
+				s.RemoveClient(client.clientID)
+				client.socket().Close()
+			}(client)
+		}
+		wg.Wait()
+
+		if app, ok := s.ccApp.(*ccImpl); ok {
+			app.Close()
+		}
+		s.appModeHandler.Close()
+	})
+}
+
 func (s *Service) Handle() {
+	go s.watchIdle()
+	if s.isOnDemand() {
+		// instances stream to their own client, see attachInstance
+		s.appModeHandler.Prewarm()
+		return
+	}
+
+	// the streams of the clients are never closed, their Handle stops on cancel
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Println("Recovered when sent to closed Video Stream channel", r)
-			}
-		}()
 		for p := range s.ccApp.VideoStream() {
-			for id, client := range s.clients {
-				select {
-				case <-client.cancel:
-					log.Println("Closing Video Audio")
-					// stop producing for client
-					delete(s.clients, id)
-					close(client.audioStream)
-					close(client.videoStream)
-				case client.videoStream <- p:
-				}
-			}
+			s.fanOut(p, metrics.StreamVideo, videoStreamOf)
 		}
 	}()
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Println("Recovered when sent to closed Video Stream channel", r)
-			}
-		}()
 		for p := range s.ccApp.AudioStream() {
-			for _, client := range s.clients {
-				select {
-				// case <-client.cancel:
-				// fmt.Println("Closing Audio")
-				// stop producing for client
-				// close(client.audioStream)
-				case client.audioStream <- p:
-				}
-			}
+			s.fanOut(p, metrics.StreamAudio, audioStreamOf)
 		}
 	}()
 	s.ccApp.Handle()
@@ -0,0 +1,199 @@
+package cloudapp
+
+import (
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// A client keeps its seat, in the app or in the waiting queue, while its websocket
+// is down for the reconnect grace. The browser resumes it with the session ID.
+
+// ResumeClient moves the client of the session to the new websocket, it returns nil
+// if the session is unknown or belongs to another user. hasPeer is false if the browser
+// lost its peer with the session, ex. the page is reloaded.
+func (s *Service) ResumeClient(sessionID string, userID string, hasPeer bool, ws *cws.Client) *Client {
+	s.clientsLock.Lock()
+	client, ok := s.sessions[sessionID]
+	// clients signaled over HTTP have no websocket to resume
+	if !ok || s.isClosed() || client.socket() == nil {
+		s.clientsLock.Unlock()
+		return nil
+	}
+	if userID == "" {
+		userID = client.clientID
+	}
+	if userID != client.userID {
+		s.clientsLock.Unlock()
+		client.log.Warn("Refused to resume the session for another user", "user", userID)
+		return nil
+	}
+	client.stopGrace()
+	old := client.socket()
+	client.setSocket(ws)
+	ws.SetLogger(client.log)
+	position := 0
+	for i, waiting := range s.waiting {
+		if waiting == client {
+			position = i + 1
+		}
+	}
+	s.clientsLock.Unlock()
+
+	client.log.Info("Resumed the client")
+	// the old websocket may not have timed out yet, ex. the browser switched network
+	old.Send(cws.WSPacket{Type: "SESSION_MOVED"}, nil)
+	old.Close()
+	client.send(cws.WSPacket{Type: "SESSION", Data: client.sessionID})
+	if position > 0 {
+		client.sendQueuePosition(position)
+		return client
+	}
+	if !client.isAdmitted() {
+		return client
+	}
+	if !hasPeer {
+		// a new page starts over with a new peer, it replaces the old one
+		client.send(cws.WSPacket{Type: "init", Data: client.webrtcConf.BrowserICEServers()})
+		client.send(cws.WSPacket{Type: "ROLE", Data: client.role()})
+		if app, ok := s.ccApp.(*ccImpl); ok {
+			client.sendScreenSize(app)
+		}
+		return client
+	}
+	client.send(cws.WSPacket{Type: "ROLE", Data: client.role()})
+	// the network of the browser may have changed
+	client.restartICE()
+	return client
+}
+
+// DisconnectClient removes the client after the reconnect grace unless it resumes.
+// ws is the dropped websocket, nothing is done if the client already resumed on another one.
+func (s *Service) DisconnectClient(clientID string, ws *cws.Client) {
+	grace := time.Duration(s.getConfig().ReconnectGrace) * time.Second
+	s.clientsLock.Lock()
+	client := s.findClient(clientID)
+	if client == nil || client.socket() != ws {
+		s.clientsLock.Unlock()
+		return
+	}
+	if grace <= 0 || s.isClosed() {
+		s.clientsLock.Unlock()
+		s.RemoveClient(clientID)
+		return
+	}
+	client.log.Info("Client disconnected, keeping its seat", "grace", grace)
+	client.stopGrace()
+	client.grace = time.AfterFunc(grace, func() {
+		s.clientsLock.Lock()
+		resumed := client.socket() != ws
+		if !resumed {
+			// the session can't be resumed from now on
+			delete(s.sessions, client.sessionID)
+		}
+		s.clientsLock.Unlock()
+		if !resumed {
+			client.log.Info("Client did not reconnect", "grace", grace)
+			s.RemoveClient(clientID)
+		}
+	})
+	s.clientsLock.Unlock()
+}
+
+// The methods below must be called with clientsLock held
+
+// findClient returns the admitted or waiting client, nil if not found
+func (s *Service) findClient(clientID string) *Client {
+	if client, ok := s.clients[clientID]; ok {
+		return client
+	}
+	for _, client := range s.waiting {
+		if client.clientID == clientID {
+			return client
+		}
+	}
+	return nil
+}
+
+// forgetSession stops resuming the client
+func (s *Service) forgetSession(client *Client) {
+	client.stopGrace()
+	delete(s.sessions, client.sessionID)
+}
+
+func (c *Client) stopGrace() {
+	if c.grace != nil {
+		c.grace.Stop()
+		c.grace = nil
+	}
+}
+
+// send sends the packet to the current websocket of the client
+func (c *Client) send(packet cws.WSPacket) {
+	if ws := c.socket(); ws != nil {
+		ws.Send(packet, nil)
+	}
+}
+
+// push sends the message over the data channel of the current peer
+func (c *Client) push(t webrtc.MessageType, payload interface{}) {
+	peer := c.peer()
+	if peer == nil || !peer.IsConnected() {
+		return
+	}
+	if err := peer.Send(t, payload); err != nil {
+		c.log.Warn("Cannot push the message", "type", t, "err", err)
+	}
+}
+
+func (c *Client) socket() *cws.Client {
+	c.wsLock.Lock()
+	defer c.wsLock.Unlock()
+	return c.ws
+}
+
+func (c *Client) setSocket(ws *cws.Client) {
+	c.wsLock.Lock()
+	c.ws = ws
+	c.wsLock.Unlock()
+}
+
+// peer returns the current WebRTC peer, nil before the first initwebrtc
+func (c *Client) peer() *webrtc.WebRTC {
+	c.rtcLock.Lock()
+	defer c.rtcLock.Unlock()
+	return c.rtcConn
+}
+
+// setPeer replaces the WebRTC peer and returns the previous one
+func (c *Client) setPeer(peer *webrtc.WebRTC) *webrtc.WebRTC {
+	c.rtcLock.Lock()
+	defer c.rtcLock.Unlock()
+	old := c.rtcConn
+	c.rtcConn = peer
+	return old
+}
+
+// newPeer returns a peer logging with the context of the client
+func (c *Client) newPeer() *webrtc.WebRTC {
+	peer := webrtc.NewWebRTC()
+	peer.SetLogger(c.log)
+	return peer
+}
+
+// restartICE sends the browser an offer restarting ICE on the current peer.
+// The browser starts over with a new peer if there is none alive.
+func (c *Client) restartICE() {
+	peer := c.peer()
+	if peer == nil || peer.IsClosed() {
+		c.send(cws.WSPacket{Type: "init", Data: c.webrtcConf.BrowserICEServers()})
+		return
+	}
+	offer, err := peer.RestartICE()
+	if err != nil {
+		c.log.Warn("Cannot restart ICE", "err", err)
+		return
+	}
+	c.send(cws.WSPacket{Type: "offer", Data: offer})
+}
@@ -0,0 +1,147 @@
+package cloudapp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+const (
+	// statsInterval is the interval the stats of the peers are pulled
+	statsInterval = 5 * time.Second
+	// statsWindowSize is the number of samples kept per client, two minutes
+	statsWindowSize = 24
+)
+
+// QualitySample is the quality of the stream of a client over a stats interval
+type QualitySample struct {
+	Time time.Time `json:"time"`
+	// Bitrate is the RTP sent, video and audio
+	Bitrate float64 `json:"bitrate_kbps"`
+	// PacketLoss is the part of the video packets lost, in percent
+	PacketLoss float64 `json:"packet_loss_pct"`
+	// NACKs, PLIs and FramesSent are counted over the interval
+	NACKs      uint64  `json:"nacks"`
+	PLIs       uint64  `json:"plis"`
+	FramesSent uint64  `json:"frames_sent"`
+	FPS        int     `json:"fps"`
+	RTT        float64 `json:"rtt_ms"`
+	Jitter     float64 `json:"jitter_ms"`
+}
+
+// ClientStats is the quality of the stream of a client
+type ClientStats struct {
+	ClientID string `json:"client_id"`
+	Role     string `json:"role"`
+	Peer     string `json:"peer"`
+	// the totals of the current peer
+	PacketsSent uint64 `json:"packets_sent"`
+	BytesSent   uint64 `json:"bytes_sent"`
+	FramesSent  uint64 `json:"frames_sent"`
+	PacketsLost uint32 `json:"packets_lost"`
+	NACKs       uint64 `json:"nacks"`
+	PLIs        uint64 `json:"plis"`
+	// Samples are the recent intervals, the oldest first
+	Samples []QualitySample `json:"samples"`
+}
+
+// statsTracker keeps the recent stats of the peers of a client
+type statsTracker struct {
+	lock    sync.Mutex
+	samples []QualitySample
+	// last are the counters of peer at the previous pull
+	peer *webrtc.WebRTC
+	last webrtc.Stats
+}
+
+// add computes the sample since the previous stats of the peer
+func (t *statsTracker) add(peer *webrtc.WebRTC, s webrtc.Stats) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	last := t.last
+	samePeer := t.peer == peer
+	t.peer, t.last = peer, s
+	if !samePeer {
+		// the counters start over with the peer
+		return
+	}
+	elapsed := s.Time.Sub(last.Time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	sample := QualitySample{
+		Time:       s.Time,
+		Bitrate:    float64(s.BytesSent-last.BytesSent) * 8 / 1000 / elapsed,
+		NACKs:      s.NACKs - last.NACKs,
+		PLIs:       s.PLIs - last.PLIs,
+		FramesSent: s.FramesSent - last.FramesSent,
+		FPS:        s.FPS,
+		RTT:        ms(s.RTT),
+		Jitter:     ms(s.Jitter),
+	}
+	// the remote peer reports the total lost, it may decrease with duplicates
+	if sent := s.VideoPacketsSent - last.VideoPacketsSent; sent > 0 && s.PacketsLost > last.PacketsLost {
+		sample.PacketLoss = float64(s.PacketsLost-last.PacketsLost) * 100 / float64(sent)
+	}
+	if len(t.samples) == statsWindowSize {
+		t.samples = t.samples[1:]
+	}
+	t.samples = append(t.samples, sample)
+}
+
+// report returns the stats of the client
+func (t *statsTracker) report() ClientStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return ClientStats{
+		PacketsSent: t.last.PacketsSent,
+		BytesSent:   t.last.BytesSent,
+		FramesSent:  t.last.FramesSent,
+		PacketsLost: t.last.PacketsLost,
+		NACKs:       t.last.NACKs,
+		PLIs:        t.last.PLIs,
+		Samples:     append([]QualitySample{}, t.samples...),
+	}
+}
+
+// collectStats pulls the stats of the peer until it's stopped
+func (c *Client) collectStats(peer *webrtc.WebRTC) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.Done():
+			return
+		case <-ticker.C:
+			if !peer.IsConnected() {
+				continue
+			}
+			stats := peer.Stats()
+			c.stats.add(peer, stats)
+			if stats.RTT > 0 {
+				metrics.PeerRTT.Observe(stats.RTT.Seconds())
+			}
+		}
+	}
+}
+
+// ClientStats returns the stats of the clients with a peer
+func (s *Service) ClientStats() []ClientStats {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	stats := []ClientStats{}
+	for _, client := range s.clients {
+		peer := client.peer()
+		if peer == nil {
+			continue
+		}
+		report := client.stats.report()
+		report.ClientID = client.clientID
+		report.Role = client.role()
+		report.Peer = peer.State().String()
+		stats = append(stats, report)
+	}
+	return stats
+}
@@ -0,0 +1,118 @@
+package cloudapp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	"github.com/pion/turn/v2"
+)
+
+// turnRelay is the embedded TURN server. It relays the media of peers which can't
+// reach the server directly, ex. behind symmetric NAT.
+type turnRelay struct {
+	server *turn.Server
+	// secret signs the short-lived credentials, it changes on every start
+	secret string
+	// ice advertises the relay to the peers
+	ice webrtc.ICEServer
+}
+
+// newTURNRelay listens on the UDP and TCP port of the config. The relay address
+// is the public IP, default to the host of instanceAddr.
+func newTURNRelay(cfg config.TURNConfig, instanceAddr string) (*turnRelay, error) {
+	ip, err := relayIP(cfg.PublicIP, instanceAddr)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	r := &turnRelay{secret: hex.EncodeToString(secret)}
+
+	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
+	udp, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	relayAddress := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: ip,
+			Address:      "0.0.0.0",
+			MinPort:      uint16(cfg.MinRelayPort),
+			MaxPort:      uint16(cfg.MaxRelayPort),
+		}
+	}
+	r.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:             cfg.Realm,
+		AuthHandler:       r.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udp, RelayAddressGenerator: relayAddress()}},
+		ListenerConfigs:   []turn.ListenerConfig{{Listener: tcp, RelayAddressGenerator: relayAddress()}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, err
+	}
+
+	r.ice = webrtc.ICEServer{Secret: r.secret, TTL: time.Duration(cfg.TTL) * time.Second}
+	r.ice.URLs = []string{
+		fmt.Sprintf("turn:%s:%d?transport=udp", ip, cfg.Port),
+		fmt.Sprintf("turn:%s:%d?transport=tcp", ip, cfg.Port),
+	}
+	slog.Info("TURN relay is listening", "addr", addr, "relay_ip", ip.String())
+	return r, nil
+}
+
+// relayIP returns the public IP, or the IP of the instance address
+func relayIP(publicIP string, instanceAddr string) (net.IP, error) {
+	host := publicIP
+	if host == "" {
+		h, _, err := net.SplitHostPort(instanceAddr)
+		if err != nil {
+			return nil, fmt.Errorf("turn relay address: %v", err)
+		}
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("turn relay address: %v", err)
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("turn relay address: %s has no IPv4", host)
+}
+
+// authenticate accepts the credentials issued by webrtc.TURNCredentials until they expire
+func (r *turnRelay) authenticate(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiry, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		slog.Warn("TURN relay refused the credentials", "username", username, "addr", srcAddr.String())
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, webrtc.TURNPassword(r.secret, username)), true
+}
+
+// Close stops relaying
+func (r *turnRelay) Close() error {
+	return r.server.Close()
+}
@@ -1,28 +1,88 @@
 package webrtc
 
-import "github.com/pion/webrtc/v3"
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
 
 type Config struct {
+	// Configuration of the peer, its ICE servers are resolved by ForUser
 	webrtc.Configuration
+	ICEServers []ICEServer
 
 	Nat1to1             string
 	DisableInterceptors bool
 	VideoCodec          string
 }
 
+// ICEServer is a STUN/TURN server. With a Secret, each user gets time-limited
+// credentials of the TURN REST API instead of the static ones.
+type ICEServer struct {
+	webrtc.ICEServer
+	// Secret is shared with the TURN server, ex. static-auth-secret of coturn
+	Secret string
+	TTL    time.Duration
+}
+
 var DefaultConfig = Config{
-	Configuration: webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
-	},
+	ICEServers: []ICEServer{{ICEServer: webrtc.ICEServer{URLs: []string{"stun:stun.l.google.com:19302"}}}},
 	VideoCodec: webrtc.MimeTypeH264,
 }
 
-func (c *Config) GetStun() string {
-	if len(c.Configuration.ICEServers) == 0 {
-		return ""
+// ForUser returns a copy of the config with the ICE servers and the credentials of the user
+func (c *Config) ForUser(user string) *Config {
+	conf := *c
+	conf.Configuration.ICEServers = make([]webrtc.ICEServer, 0, len(c.ICEServers))
+	for _, s := range c.ICEServers {
+		server := s.ICEServer
+		if s.Secret != "" {
+			server.Username, server.Credential = TURNCredentials(s.Secret, user, time.Now().Add(s.TTL))
+			server.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		conf.Configuration.ICEServers = append(conf.Configuration.ICEServers, server)
+	}
+	return &conf
+}
+
+// TURNCredentials returns the TURN REST API credentials of the user valid until expiry:
+// the username is "expiry:user" and the password is base64(HMAC-SHA1(secret, username))
+func TURNCredentials(secret string, user string, expiry time.Time) (string, string) {
+	username := strconv.FormatInt(expiry.Unix(), 10)
+	if user != "" {
+		username += ":" + user
 	}
-	// hello, npe
-	return c.Configuration.ICEServers[0].URLs[0]
+	return username, TURNPassword(secret, username)
+}
+
+// TURNPassword returns the TURN REST API password of the username
+func TURNPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// browserICEServer is an RTCIceServer of the browser
+type browserICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// BrowserICEServers returns the resolved ICE servers as the JSON list of RTCIceServer given to the browser
+func (c *Config) BrowserICEServers() string {
+	servers := make([]browserICEServer, 0, len(c.Configuration.ICEServers))
+	for _, s := range c.Configuration.ICEServers {
+		credential, _ := s.Credential.(string)
+		servers = append(servers, browserICEServer{URLs: s.URLs, Username: s.Username, Credential: credential})
+	}
+	b, _ := json.Marshal(servers)
+	return string(b)
 }
 
 func (c *Config) Override(options ...Option) {
@@ -56,15 +116,24 @@ func Nat1to1(natIp string) Option { return func(c *Config) { c.Nat1to1 = natIp }
 
 func StunServer(server string) Option {
 	return func(c *Config) {
-		var ice []webrtc.ICEServer
+		var ice []ICEServer
 		if server == "" {
 			return
 		}
 		if server == "none" {
-			ice = []webrtc.ICEServer{}
+			ice = []ICEServer{}
 		} else {
-			ice = append(ice, webrtc.ICEServer{URLs: []string{server}})
+			ice = append(ice, ICEServer{ICEServer: webrtc.ICEServer{URLs: []string{server}}})
+		}
+		c.ICEServers = ice
+	}
+}
+
+// ICEServers replaces the ICE servers if the list is not empty
+func ICEServers(servers []ICEServer) Option {
+	return func(c *Config) {
+		if len(servers) > 0 {
+			c.ICEServers = servers
 		}
-		c.Configuration.ICEServers = ice
 	}
 }
@@ -0,0 +1,101 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Messages the server pushes to the remote peer over the data channels, with lower
+// latency than the websocket. Each type is registered with its payload. Reliable
+// messages go on the state channel, lossy ones, superseded by the next, on the
+// motion channel. On the wire a message is {"type": "TITLE", "data": {...}}.
+
+// MessageType identifies a message pushed to the remote peer
+type MessageType string
+
+const (
+	// MessageCursor is the cursor shape and position, lossy
+	MessageCursor MessageType = "CURSOR"
+	// MessageTitle is the title of the app window
+	MessageTitle MessageType = "TITLE"
+	// MessageClipboard is the text of the remote clipboard
+	MessageClipboard MessageType = "CLIPBOARD"
+	// MessagePing probes the latency of the remote peer, lossy
+	MessagePing MessageType = "PING"
+)
+
+// Cursor is the payload of MessageCursor, in screen coordinates of the app
+type Cursor struct {
+	X       float32 `json:"x"`
+	Y       float32 `json:"y"`
+	Shape   string  `json:"shape,omitempty"` // CSS cursor, ex. pointer, text
+	Visible bool    `json:"visible"`
+}
+
+// Title is the payload of MessageTitle
+type Title struct {
+	Title string `json:"title"`
+}
+
+// Clipboard is the payload of MessageClipboard
+type Clipboard struct {
+	Text string `json:"text"`
+}
+
+// Ping is the payload of MessagePing
+type Ping struct {
+	ID   uint32 `json:"id"`
+	Time int64  `json:"time"` // Unix milliseconds of the server
+}
+
+// ErrUnknownMessage is returned when pushing a type which isn't registered
+var ErrUnknownMessage = errors.New("webrtc: unknown message type")
+
+type messageSpec struct {
+	payload reflect.Type
+	lossy   bool
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[MessageType]messageSpec{
+		MessageCursor:    {reflect.TypeOf(Cursor{}), true},
+		MessageTitle:     {reflect.TypeOf(Title{}), false},
+		MessageClipboard: {reflect.TypeOf(Clipboard{}), false},
+		MessagePing:      {reflect.TypeOf(Ping{}), true},
+	}
+)
+
+// RegisterMessage registers the payload of a message type and returns the type.
+// Registering a type again with another payload panics.
+func RegisterMessage(t MessageType, payload interface{}, lossy bool) MessageType {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	spec := messageSpec{reflect.TypeOf(payload), lossy}
+	if old, ok := registry[t]; ok && old != spec {
+		panic(fmt.Sprintf("webrtc: message %s is already registered with %v", t, old.payload))
+	}
+	registry[t] = spec
+	return t
+}
+
+// encodeMessage returns the message as sent on the data channel
+func encodeMessage(t MessageType, payload interface{}) (data []byte, lossy bool, err error) {
+	registryLock.RLock()
+	spec, ok := registry[t]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, false, ErrUnknownMessage
+	}
+	if reflect.TypeOf(payload) != spec.payload {
+		return nil, false, fmt.Errorf("webrtc: message %s needs a %v payload, not %T", t, spec.payload, payload)
+	}
+	data, err = json.Marshal(struct {
+		Type MessageType `json:"type"`
+		Data interface{} `json:"data"`
+	}{t, payload})
+	return data, spec.lossy, err
+}
@@ -0,0 +1,86 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Clock rates of the tracks, the jitter of the receiver reports is in their units
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+)
+
+// maxRTT bounds the RTT of the receiver reports, in 1/65536 seconds
+const maxRTT = 10 << 16
+
+// NetworkStats is the view of the remote peer on the video, from its RTCP receiver reports
+type NetworkStats struct {
+	// RTT is the round trip of the last sender report, zero until one is answered
+	RTT time.Duration
+	// Jitter is the interarrival jitter of the video packets
+	Jitter time.Duration
+	// FractionLost is the part of the video packets lost since the previous report, 0 to 1
+	FractionLost float64
+	// PacketsLost is the number of video packets lost since the start
+	PacketsLost uint32
+}
+
+// NetworkStats returns the last RTCP receiver report of the video
+func (w *WebRTC) NetworkStats() NetworkStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.network
+}
+
+// readRTCP reads the RTCP of the sender until the peer is stopped. The interceptors,
+// ex. NACK and the sender reports, only run while RTCP is read.
+func (w *WebRTC) readRTCP(sender *webrtc.RTPSender, clockRate uint32) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			// the sender is stopped with the connection
+			return
+		}
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverReport:
+				if clockRate == videoClockRate {
+					w.onReceiverReport(p, clockRate)
+				}
+			case *rtcp.TransportLayerNack, *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				w.countFeedback(p)
+			}
+		}
+	}
+}
+
+func (w *WebRTC) onReceiverReport(report *rtcp.ReceiverReport, clockRate uint32) {
+	now := ntpCompact(time.Now())
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, r := range report.Reports {
+		w.network.Jitter = time.Duration(r.Jitter) * time.Second / time.Duration(clockRate)
+		w.network.FractionLost = float64(r.FractionLost) / 256
+		w.network.PacketsLost = r.TotalLost
+		// RFC 3550 6.4.1, in 1/65536 seconds
+		if r.LastSenderReport == 0 {
+			continue
+		}
+		// a wrapped difference is a report of an older sender report
+		if rtt := now - r.LastSenderReport - r.Delay; rtt < maxRTT {
+			w.network.RTT = time.Duration(rtt) * time.Second / 65536
+		}
+	}
+}
+
+// ntpCompact returns the middle 32 bits of the NTP timestamp of t
+func ntpCompact(t time.Time) uint32 {
+	// seconds from 1900 to 1970
+	const ntpEpochOffset = 2208988800
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction>>16)
+}
@@ -0,0 +1,128 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Stats are the counters of a peer since it started
+type Stats struct {
+	Time time.Time
+	// PacketsSent and BytesSent are the RTP of the video and audio tracks
+	PacketsSent      uint64
+	BytesSent        uint64
+	VideoPacketsSent uint64
+	// FramesSent counts the video frames, FPS is the frame rate of the last second
+	FramesSent uint64
+	FPS        int
+	// PacketsLost is the video reported lost by the remote peer
+	PacketsLost uint32
+	// NACKs is the number of packets the remote peer asked again, PLIs its requests of a key frame
+	NACKs uint64
+	PLIs  uint64
+	// RTT is the round trip of the ICE candidate pair, default to the one of RTCP
+	RTT    time.Duration
+	Jitter time.Duration
+	// TransportBytesSent and TransportBytesReceived include RTCP, the data channels and ICE
+	TransportBytesSent     uint64
+	TransportBytesReceived uint64
+}
+
+// streamCounters are the counters of the RTP and RTCP of the peer, guarded by the lock of the peer
+type streamCounters struct {
+	packetsSent      uint64
+	bytesSent        uint64
+	videoPacketsSent uint64
+	framesSent       uint64
+	nacks            uint64
+	plis             uint64
+	// frames since lastTime, for curFPS
+	frames int
+}
+
+// Stats returns the counters of the peer with the stats of its connection
+func (w *WebRTC) Stats() Stats {
+	w.lock.Lock()
+	s := Stats{
+		Time:             time.Now(),
+		PacketsSent:      w.counters.packetsSent,
+		BytesSent:        w.counters.bytesSent,
+		VideoPacketsSent: w.counters.videoPacketsSent,
+		FramesSent:       w.counters.framesSent,
+		FPS:              w.curFPS,
+		PacketsLost:      w.network.PacketsLost,
+		NACKs:            w.counters.nacks,
+		PLIs:             w.counters.plis,
+		RTT:              w.network.RTT,
+		Jitter:           w.network.Jitter,
+	}
+	if time.Since(w.lastTime) > 2*time.Second {
+		// the stream is stalled
+		s.FPS = 0
+	}
+	connection := w.connection
+	w.lock.Unlock()
+	if connection == nil {
+		return s
+	}
+
+	for _, stats := range connection.GetStats() {
+		switch stats := stats.(type) {
+		case webrtc.ICECandidatePairStats:
+			if stats.Nominated && stats.CurrentRoundTripTime > 0 {
+				s.RTT = time.Duration(stats.CurrentRoundTripTime * float64(time.Second))
+			}
+		case webrtc.TransportStats:
+			s.TransportBytesSent = stats.BytesSent
+			s.TransportBytesReceived = stats.BytesReceived
+		}
+	}
+	return s
+}
+
+// countPacket counts a packet written to a track, and the frame it ends
+func (w *WebRTC) countPacket(packet *rtp.Packet, video bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.counters.packetsSent++
+	w.counters.bytesSent += uint64(packet.MarshalSize())
+	if !video {
+		metrics.RTPPacketsOut.WithLabelValues(metrics.StreamAudio).Inc()
+		return
+	}
+	metrics.RTPPacketsOut.WithLabelValues(metrics.StreamVideo).Inc()
+	w.counters.videoPacketsSent++
+	// the marker is on the last packet of a frame
+	if !packet.Marker {
+		return
+	}
+	w.counters.framesSent++
+	metrics.FramesSent.Inc()
+	w.counters.frames++
+	if elapsed := time.Since(w.lastTime); elapsed >= time.Second {
+		w.curFPS = int(float64(w.counters.frames) / elapsed.Seconds())
+		w.counters.frames = 0
+		w.lastTime = time.Now()
+	}
+}
+
+// countFeedback counts the requests of the remote peer in its RTCP
+func (w *WebRTC) countFeedback(packet rtcp.Packet) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	switch p := packet.(type) {
+	case *rtcp.TransportLayerNack:
+		for _, pair := range p.Nacks {
+			n := len(pair.PacketList())
+			w.counters.nacks += uint64(n)
+			metrics.RTCPFeedback.WithLabelValues("nack").Add(float64(n))
+		}
+	case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+		w.counters.plis++
+		metrics.RTCPFeedback.WithLabelValues("pli").Inc()
+	}
+}
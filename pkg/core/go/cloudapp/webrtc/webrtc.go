@@ -1,31 +1,115 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 	"github.com/gofrs/uuid"
 	"github.com/pion/interceptor"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
+// iceDisconnectGrace is the time a disconnected peer has to recover by itself before an ICE restart
+const iceDisconnectGrace = 5 * time.Second
+
+// iceRestartTimeout is the time an ICE restart has to reconnect before the peer is stopped
+const iceRestartTimeout = 30 * time.Second
+
+// Labels of the data channels. The server opens them when it offers, the remote peer when it offers.
+const (
+	// inputChannelLabel carries keys and clicks, ordered and reliable
+	inputChannelLabel = "app-input"
+	// motionChannelLabel carries mouse moves and gamepad axes, unordered without
+	// retransmits: a lost move is superseded by the next one
+	motionChannelLabel = "app-motion"
+	// controlChannelLabel carries the control messages of the session, ordered and reliable
+	controlChannelLabel = "app-control"
+	// stateChannelLabel carries the messages of the server, ordered and reliable, see Send
+	stateChannelLabel = "app-state"
+)
+
+// iceGatheringTimeout bounds the wait for the local candidates of an answer
+const iceGatheringTimeout = 3 * time.Second
+
+// ErrPeerClosed is returned by the methods of a stopped peer
+var ErrPeerClosed = errors.New("webrtc: peer is closed")
+
+// PeerState is the state of a peer, it only moves forward to PeerClosed
+type PeerState int
+
+const (
+	// PeerNew the peer is negotiating
+	PeerNew PeerState = iota
+	// PeerConnected ICE is connected, the tracks are streaming
+	PeerConnected
+	// PeerReconnecting ICE is disconnected or restarting
+	PeerReconnecting
+	// PeerClosed the peer is stopped, it can't be started again
+	PeerClosed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerNew:
+		return "new"
+	case PeerConnected:
+		return "connected"
+	case PeerReconnecting:
+		return "reconnecting"
+	case PeerClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// WebRTC is a peer streaming the app to a client. The peer owns its channels:
+// they are never closed, writers and readers stop on Done instead.
 type WebRTC struct {
 	ID string
 
-	connection  *webrtc.PeerConnection
-	isConnected bool
-	isClosed    bool
-
+	// OnICERestart is called when the connection needs an ICE restart, see RestartICE.
+	// Without it, the peer is stopped once disconnected.
+	OnICERestart func()
+	// OnClose is called once the peer is stopped
+	OnClose func()
+
+	log *slog.Logger
+
+	// lock guards connection, state, iceTimer, the stats and the data channels to send on
+	lock       sync.Mutex
+	connection *webrtc.PeerConnection
+	state      PeerState
+	iceTimer   *time.Timer
+	stateData  *webrtc.DataChannel
+	motionData *webrtc.DataChannel
+	network    NetworkStats
+	counters   streamCounters
+	streamOnce sync.Once
+	// ctx is cancelled when the peer is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// ImageChannel and AudioChannel are the RTP packets to stream
 	ImageChannel chan *rtp.Packet
 	AudioChannel chan *rtp.Packet
+	// InputChannel is the reliable input of the remote peer, keys and clicks
 	InputChannel chan []byte
+	// MotionChannel is the lossy input of the remote peer, the latest moves
+	MotionChannel chan []byte
+	// ControlChannel is the control messages of the remote peer
+	ControlChannel chan []byte
 
-	Done     bool
+	// lastTime is the start of the frame rate count, curFPS the rate of the previous count
 	lastTime time.Time
 	curFPS   int
 }
@@ -57,106 +141,219 @@ func Decode(in string, obj interface{}) error {
 
 // NewWebRTC create
 func NewWebRTC() *WebRTC {
+	ctx, cancel := context.WithCancel(context.Background())
 	w := &WebRTC{
 		ID: uuid.Must(uuid.NewV4()).String(),
 
-		ImageChannel: make(chan *rtp.Packet, 100),
-		AudioChannel: make(chan *rtp.Packet, 100),
-		InputChannel: make(chan []byte, 100),
+		ctx:    ctx,
+		cancel: cancel,
+
+		log: slog.Default(),
+
+		ImageChannel:   make(chan *rtp.Packet, 100),
+		AudioChannel:   make(chan *rtp.Packet, 100),
+		InputChannel:   make(chan []byte, 100),
+		MotionChannel:  make(chan []byte, 100),
+		ControlChannel: make(chan []byte, 10),
 	}
+	w.log = w.log.With(logging.KeyPeer, w.ID)
 	return w
 }
 
-// StartClient start webrtc
-func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (string, error) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println(err)
-			w.StopClient()
-		}
-	}()
-	var err error
-	var videoTrack *webrtc.TrackLocalStaticRTP
+// SetLogger sets the logger with the context of the client of the peer.
+// It must be called before the peer is started.
+func (w *WebRTC) SetLogger(logger *slog.Logger) {
+	w.log = logger.With(logging.KeyPeer, w.ID)
+}
 
-	// reset client
-	if w.isConnected {
-		w.StopClient()
-		time.Sleep(2 * time.Second)
+// StartClient start webrtc. The peer is stopped if it fails.
+func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (_ string, err error) {
+	defer w.stopOnError(&err)
+	w.log.Debug("Starting the peer with an offer")
+	connection, err := w.newConnection(conf, onIceCandidate)
+	if err != nil {
+		return "", err
+	}
+	// the browser answers the channels of the offer
+	if err = w.createDataChannels(connection); err != nil {
+		return "", err
 	}
 
-	log.Println("=== StartClient ===")
-	w.connection, err = NewPeerConnection(conf)
+	_, err = connection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
 	if err != nil {
 		return "", err
 	}
 
-	// add video track
-	videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: conf.VideoCodec}, "video", "pion")
+	// Stream provider supposes to send offer
+	offer, err := connection.CreateOffer(nil)
+	if err != nil {
+		return "", err
+	}
+	w.log.Debug("Created the offer")
 
+	err = connection.SetLocalDescription(offer)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = w.connection.AddTrack(videoTrack)
+	localSession, err := Encode(offer)
 	if err != nil {
 		return "", err
 	}
-	log.Println("Add video track")
 
-	// add audio track
-	opusTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	return localSession, nil
+}
+
+// AnswerClient starts webrtc with the SDP offer of the remote peer, ex. a WHEP player
+// or a native client. The video is sent with the codec of the config, the offer must
+// support it. With onIceCandidate, the answer is returned at once and the candidates
+// trickle. Without, it's returned once ICE gathering completes and holds the candidates.
+// The peer is stopped if it fails.
+func (w *WebRTC) AnswerClient(offerSDP string, conf *Config, onIceCandidate func(c string)) (_ string, err error) {
+	defer w.stopOnError(&err)
+	w.log.Debug("Starting the peer with the offer of the client")
+	trickle := onIceCandidate != nil
+	if !trickle {
+		// candidates are sent in the answer
+		onIceCandidate = func(string) {}
+	}
+	connection, err := w.newConnection(conf, onIceCandidate)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(connection)
+
+	err = connection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP})
 	if err != nil {
 		return "", err
 	}
-	_, err = w.connection.AddTrack(opusTrack)
+	if !negotiated(connection, conf.VideoCodec) {
+		return "", fmt.Errorf("the offer does not support %s", conf.VideoCodec)
+	}
+	answer, err := connection.CreateAnswer(nil)
 	if err != nil {
 		return "", err
 	}
+	if err = connection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	if !trickle {
+		select {
+		case <-gathered:
+		case <-w.ctx.Done():
+			return "", ErrPeerClosed
+		case <-time.After(iceGatheringTimeout):
+			w.log.Warn("ICE gathering timed out, answering with the candidates so far", "timeout", iceGatheringTimeout)
+		}
+	}
+	w.log.Debug("Created the answer")
+	return connection.LocalDescription().SDP, nil
+}
 
-	_, err = w.connection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+func (w *WebRTC) stopOnError(err *error) {
+	if *err != nil {
+		w.StopClient()
+	}
+}
 
-	// create data channel for input, and register callbacks
-	// order: true, negotiated: false, id: random
-	inputTrack, err := w.connection.CreateDataChannel("app-input", nil)
+// negotiated returns true if the remote offer accepts the codec on the video track
+func negotiated(connection *webrtc.PeerConnection, mimeType string) bool {
+	for _, t := range connection.GetTransceivers() {
+		sender := t.Sender()
+		if sender == nil || sender.Track() == nil || sender.Track().Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		for _, codec := range sender.GetParameters().Codecs {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	inputTrack.OnOpen(func() {
-		log.Printf("Data channel '%s'-'%d' open.\n", inputTrack.Label(), inputTrack.ID())
-	})
+// newConnection creates the peer connection with the app tracks. A peer has one connection.
+func (w *WebRTC) newConnection(conf *Config, onIceCandidate func(c string)) (*webrtc.PeerConnection, error) {
+	connection, err := NewPeerConnection(conf, w.log)
+	if err != nil {
+		return nil, err
+	}
+	w.lock.Lock()
+	if w.state == PeerClosed || w.connection != nil {
+		w.lock.Unlock()
+		connection.Close()
+		return nil, ErrPeerClosed
+	}
+	w.connection = connection
+	w.lock.Unlock()
+	metrics.ActivePeers.Inc()
 
-	// Register text message handling
-	inputTrack.OnMessage(func(msg webrtc.DataChannelMessage) {
-		// TODO: Can add recover here
-		w.InputChannel <- msg.Data
-	})
+	// add video track
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: conf.VideoCodec}, "video", "pion")
 
-	inputTrack.OnClose(func() {
-		log.Println("Data channel closed")
-		log.Println("Closed webrtc")
-	})
+	if err != nil {
+		return nil, err
+	}
 
-	// WebRTC state callback
-	w.connection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("ICE Connection State has changed: %s\n", connectionState.String())
-		if connectionState == webrtc.ICEConnectionStateConnected {
-			go func() {
-				w.isConnected = true
-				log.Println("ConnectionStateConnected")
-				w.startStreaming(videoTrack, opusTrack)
-			}()
+	videoSender, err := connection.AddTrack(videoTrack)
+	if err != nil {
+		return nil, err
+	}
+	go w.readRTCP(videoSender, videoClockRate)
+	w.log.Debug("Added the video track", "codec", conf.VideoCodec)
 
-		}
-		if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateClosed || connectionState == webrtc.ICEConnectionStateDisconnected {
-			log.Println("ICE Connection failed")
+	// add audio track
+	opusTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	if err != nil {
+		return nil, err
+	}
+	audioSender, err := connection.AddTrack(opusTrack)
+	if err != nil {
+		return nil, err
+	}
+	go w.readRTCP(audioSender, audioClockRate)
+
+	// the remote peer opens the data channels when it offers
+	connection.OnDataChannel(w.handleDataChannel)
+
+	// WebRTC state callback
+	connection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		w.log.Info("ICE connection state changed", "state", connectionState.String())
+		switch connectionState {
+		case webrtc.ICEConnectionStateConnected:
+			if !w.setState(PeerConnected) {
+				return
+			}
+			w.setICETimer(0, nil)
+			// an ICE restart reconnects the same tracks
+			w.streamOnce.Do(func() {
+				go w.stream(videoTrack, w.ImageChannel)
+				go w.stream(opusTrack, w.AudioChannel)
+			})
+		case webrtc.ICEConnectionStateDisconnected:
+			if !w.setState(PeerReconnecting) {
+				return
+			}
+			// transient, ex. the network of the client changes
+			w.log.Info("ICE disconnected, waiting to recover", "grace", iceDisconnectGrace)
+			w.setICETimer(iceDisconnectGrace, w.restart)
+		case webrtc.ICEConnectionStateFailed:
+			if !w.setState(PeerReconnecting) {
+				return
+			}
+			w.log.Warn("ICE failed")
+			w.restart()
+		case webrtc.ICEConnectionStateClosed:
 			w.StopClient()
 		}
 	})
 
-	w.connection.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
+	connection.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
 		if iceCandidate != nil {
-			log.Println("OnIceCandidate:", iceCandidate.ToJSON().Candidate)
+			w.log.Debug("Gathered a local candidate", "candidate", iceCandidate.ToJSON().Candidate)
 			candidate, err := Encode(iceCandidate.ToJSON())
 			if err != nil {
-				log.Println("Encode IceCandidate failed: " + iceCandidate.ToJSON().Candidate)
+				w.log.Error("Cannot encode the local candidate", "candidate", iceCandidate.ToJSON().Candidate, "err", err)
 				return
 			}
 			onIceCandidate(candidate)
@@ -166,124 +363,337 @@ func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (strin
 		}
 	})
 
-	// Stream provider supposes to send offer
-	offer, err := w.connection.CreateOffer(nil)
+	return connection, nil
+}
+
+// createDataChannels creates the data channels of the input
+func (w *WebRTC) createDataChannels(connection *webrtc.PeerConnection) error {
+	unordered := false
+	var noRetransmits uint16
+	channels := []struct {
+		label string
+		init  *webrtc.DataChannelInit
+	}{
+		// order: true, negotiated: false, id: random
+		{inputChannelLabel, nil},
+		{motionChannelLabel, &webrtc.DataChannelInit{Ordered: &unordered, MaxRetransmits: &noRetransmits}},
+		{controlChannelLabel, nil},
+		{stateChannelLabel, nil},
+	}
+	for _, c := range channels {
+		d, err := connection.CreateDataChannel(c.label, c.init)
+		if err != nil {
+			return err
+		}
+		w.handleDataChannel(d)
+	}
+	return nil
+}
+
+// handleDataChannel registers the callbacks of a data channel, unknown channels are ignored
+func (w *WebRTC) handleDataChannel(d *webrtc.DataChannel) {
+	var messages chan []byte
+	switch d.Label() {
+	case inputChannelLabel:
+		messages = w.InputChannel
+	case motionChannelLabel:
+		messages = w.MotionChannel
+	case controlChannelLabel:
+		messages = w.ControlChannel
+	case stateChannelLabel:
+		// downstream only
+	default:
+		w.log.Warn("Ignored an unknown data channel", "label", d.Label())
+		return
+	}
+	lossy := d.Label() == motionChannelLabel
+	w.lock.Lock()
+	switch d.Label() {
+	case stateChannelLabel:
+		w.stateData = d
+	case motionChannelLabel:
+		w.motionData = d
+	}
+	w.lock.Unlock()
+
+	d.OnOpen(func() {
+		w.log.Debug("Data channel opened", "label", d.Label(), "id", d.ID())
+	})
+
+	// Register text message handling
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if messages == nil {
+			return
+		}
+		if lossy {
+			// don't hold the reliable channels back, the next move supersedes this one
+			select {
+			case messages <- msg.Data:
+			default:
+			}
+			return
+		}
+		select {
+		case messages <- msg.Data:
+		case <-w.ctx.Done():
+		}
+	})
+
+	d.OnClose(func() {
+		w.log.Debug("Data channel closed", "label", d.Label())
+	})
+}
+
+// Send pushes a registered message to the remote peer, see RegisterMessage.
+// Lossy messages are dropped while their channel isn't open, messages are dropped
+// if the remote offered no channel for them.
+func (w *WebRTC) Send(t MessageType, payload interface{}) error {
+	data, lossy, err := encodeMessage(t, payload)
 	if err != nil {
-		return "", err
+		return err
+	}
+	w.lock.Lock()
+	closed := w.state == PeerClosed
+	d := w.stateData
+	if lossy {
+		d = w.motionData
+	}
+	w.lock.Unlock()
+	if closed {
+		return ErrPeerClosed
+	}
+	// a remote which offered no such channel doesn't take the message
+	if d == nil {
+		return nil
+	}
+	if d.ReadyState() != webrtc.DataChannelStateOpen {
+		if lossy {
+			return nil
+		}
+		return fmt.Errorf("webrtc: %s channel is not open", stateChannelLabel)
+	}
+	return d.Send(data)
+}
+
+// setState moves the peer to the state, it returns false if the peer is closed
+func (w *WebRTC) setState(state PeerState) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.state == PeerClosed {
+		return false
+	}
+	w.state = state
+	return true
+}
+
+// State returns the current state of the peer
+func (w *WebRTC) State() PeerState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.state
+}
+
+// restart asks for an ICE restart and stops the peer if it doesn't reconnect in time
+func (w *WebRTC) restart() {
+	if w.OnICERestart == nil {
+		w.StopClient()
+		return
+	}
+	w.setICETimer(iceRestartTimeout, func() {
+		w.log.Warn("ICE restart timed out", "timeout", iceRestartTimeout)
+		w.StopClient()
+	})
+	w.OnICERestart()
+}
+
+// setICETimer replaces the pending ICE timer, f is nil to cancel it
+func (w *WebRTC) setICETimer(d time.Duration, f func()) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.iceTimer != nil {
+		w.iceTimer.Stop()
+		w.iceTimer = nil
+	}
+	if f != nil && w.state != PeerClosed {
+		w.iceTimer = time.AfterFunc(d, f)
+	}
+}
+
+// peerConnection returns the connection, ErrPeerClosed if the peer is stopped or not started
+func (w *WebRTC) peerConnection() (*webrtc.PeerConnection, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.state == PeerClosed || w.connection == nil {
+		return nil, ErrPeerClosed
 	}
-	log.Println("Created Offer")
+	return w.connection, nil
+}
 
-	err = w.connection.SetLocalDescription(offer)
+// RestartICE returns a new offer restarting ICE on the same connection.
+// The answer is set with SetRemoteSDP.
+func (w *WebRTC) RestartICE() (string, error) {
+	connection, err := w.peerConnection()
 	if err != nil {
 		return "", err
 	}
-
-	localSession, err := Encode(offer)
+	offer, err := connection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
 	if err != nil {
 		return "", err
 	}
-
-	return localSession, nil
+	if err := connection.SetLocalDescription(offer); err != nil {
+		return "", err
+	}
+	w.log.Info("Created an ICE restart offer")
+	return Encode(offer)
 }
 
 func (w *WebRTC) SetRemoteSDP(remoteSDP string) error {
+	connection, err := w.peerConnection()
+	if err != nil {
+		return err
+	}
 	var answer webrtc.SessionDescription
-	err := Decode(remoteSDP, &answer)
+	err = Decode(remoteSDP, &answer)
 	if err != nil {
-		log.Println("Decode remote sdp from peer failed")
+		w.log.Warn("Cannot decode the remote SDP", "err", err)
 		return err
 	}
 
-	fmt.Println("Wconnection", w.connection)
-	err = w.connection.SetRemoteDescription(answer)
+	err = connection.SetRemoteDescription(answer)
 	if err != nil {
-		log.Println("Set remote description from peer failed")
+		w.log.Warn("Cannot set the remote description", "err", err)
 		return err
 	}
 
-	log.Println("Set Remote Description")
+	w.log.Debug("Set the remote description")
 	return nil
 }
 
 func (w *WebRTC) AddCandidate(candidate string) error {
+	connection, err := w.peerConnection()
+	if err != nil {
+		return err
+	}
 	var iceCandidate webrtc.ICECandidateInit
-	err := Decode(candidate, &iceCandidate)
+	err = Decode(candidate, &iceCandidate)
 	if err != nil {
-		log.Println("Decode Ice candidate from peer failed")
+		w.log.Warn("Cannot decode the remote candidate", "err", err)
 		return err
 	}
-	log.Println("Decoded Ice: " + iceCandidate.Candidate)
 
-	err = w.connection.AddICECandidate(iceCandidate)
+	err = connection.AddICECandidate(iceCandidate)
 	if err != nil {
-		log.Println("Add Ice candidate from peer failed")
+		w.log.Warn("Cannot add the remote candidate", "candidate", iceCandidate.Candidate, "err", err)
 		return err
 	}
 
-	log.Println("Add Ice Candidate: " + iceCandidate.Candidate)
+	w.log.Debug("Added a remote candidate", "candidate", iceCandidate.Candidate)
 	return nil
 }
 
-// StopClient disconnect
-func (w *WebRTC) StopClient() {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered from err. Maybe we closed a closed channel", r)
+// AddSDPFragment adds the remote candidates of a trickle ICE SDP fragment, RFC 8840.
+// The candidates apply to the media section of the last a=mid line.
+func (w *WebRTC) AddSDPFragment(frag string) error {
+	connection, err := w.peerConnection()
+	if err != nil {
+		return err
+	}
+	var mid *string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid}
+			if err := connection.AddICECandidate(candidate); err != nil {
+				return err
+			}
+			w.log.Debug("Added a remote candidate", "candidate", candidate.Candidate)
 		}
-	}()
-	// if stopped, bypass
-	// if w.isConnected == false {
-	// 	return
-	// }
-
-	log.Println("===StopClient===")
-	if w.connection != nil {
-		log.Println("WebRTC Connection close")
-		w.connection.Close()
-		w.connection = nil
-	}
-	// w.isConnected = false
-	log.Println("Close Input channel")
-	close(w.InputChannel)
-	// webrtc is producer, so we close
-	// NOTE: ImageChannel is waiting for input. Close in writer is not correct for this
-	close(w.ImageChannel)
-	close(w.AudioChannel)
-}
-
-// IsConnected comment
-func (w *WebRTC) IsConnected() bool {
-	return w.isConnected
+	}
+	return nil
 }
 
-func (w *WebRTC) startStreaming(videoTrack *webrtc.TrackLocalStaticRTP, opusTrack *webrtc.TrackLocalStaticRTP) {
-	log.Println("Start streaming")
-	// receive frame buffer
-	go func() {
-		for packet := range w.ImageChannel {
-			if writeErr := videoTrack.WriteRTP(packet); writeErr != nil {
-				panic(writeErr)
-			}
+// DecodeSDP returns the SDP of a session description encoded for the websocket
+func DecodeSDP(in string) (string, error) {
+	var desc webrtc.SessionDescription
+	if err := Decode(in, &desc); err != nil {
+		return "", err
+	}
+	return desc.SDP, nil
+}
+
+// EncodeAnswer encodes the SDP answer for the websocket
+func EncodeAnswer(sdp string) (string, error) {
+	return Encode(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp})
+}
+
+// StopClient closes the connection and cancels Done. It's safe to call more than once.
+func (w *WebRTC) StopClient() {
+	w.lock.Lock()
+	if w.state == PeerClosed {
+		w.lock.Unlock()
+		return
+	}
+	w.state = PeerClosed
+	if w.iceTimer != nil {
+		w.iceTimer.Stop()
+		w.iceTimer = nil
+	}
+	connection := w.connection
+	w.lock.Unlock()
+
+	w.log.Info("Stopping the peer")
+	w.cancel()
+	if connection != nil {
+		metrics.ActivePeers.Dec()
+		if err := connection.Close(); err != nil {
+			w.log.Warn("Cannot close the connection", "err", err)
 		}
-	}()
+	}
+	if w.OnClose != nil {
+		w.OnClose()
+	}
+}
 
-	// send audio
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("Recovered from err", r)
-			}
-		}()
+// Done is closed once the peer is stopped
+func (w *WebRTC) Done() <-chan struct{} {
+	return w.ctx.Done()
+}
+
+// IsClosed returns true once the peer is stopped
+func (w *WebRTC) IsClosed() bool {
+	return w.State() == PeerClosed
+}
 
-		for packet := range w.AudioChannel {
-			if writeErr := opusTrack.WriteRTP(packet); writeErr != nil {
-				panic(writeErr)
+// IsConnected returns true while ICE is connected
+func (w *WebRTC) IsConnected() bool {
+	return w.State() == PeerConnected
+}
+
+// stream writes the packets of the channel to the track until the peer is stopped
+func (w *WebRTC) stream(track *webrtc.TrackLocalStaticRTP, packets chan *rtp.Packet) {
+	w.log.Debug("Start streaming", "track", track.Kind().String())
+	video := track.Kind() == webrtc.RTPCodecTypeVideo
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case packet := <-packets:
+			if err := track.WriteRTP(packet); err != nil {
+				w.log.Warn("Cannot write RTP, stopping the peer", "track", track.Kind().String(), "err", err)
+				w.StopClient()
+				return
 			}
+			w.countPacket(packet, video)
 		}
-	}()
+	}
 }
 
-func NewPeerConnection(conf *Config) (*webrtc.PeerConnection, error) {
+// NewPeerConnection creates a connection with the codecs and the NAT mapping of conf
+func NewPeerConnection(conf *Config, logger *slog.Logger) (*webrtc.PeerConnection, error) {
 	m := &webrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, err
@@ -300,9 +710,9 @@ func NewPeerConnection(conf *Config) (*webrtc.PeerConnection, error) {
 	if conf.Nat1to1 != "" {
 		if ip, ct, err := parseNatCandidate(conf.Nat1to1); err == nil {
 			s.SetNAT1To1IPs(ip, ct)
-			log.Printf("Using 1:1 NAT %s", conf.Nat1to1)
+			logger.Debug("Using 1:1 NAT", "mapping", conf.Nat1to1)
 		} else {
-			log.Printf("NAT map error: %v", err)
+			logger.Warn("Invalid 1:1 NAT mapping", "mapping", conf.Nat1to1, "err", err)
 		}
 	}
 
@@ -0,0 +1,285 @@
+package webrtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	pion "github.com/pion/webrtc/v3"
+)
+
+// connectTimeout bounds the connection of two peers of the same host
+const connectTimeout = 10 * time.Second
+
+// testConfig has no ICE servers, the peers connect with their host candidates
+func testConfig() *Config {
+	return &Config{VideoCodec: pion.MimeTypeH264}
+}
+
+// remotePeer is a client receiving the app, it offers the tracks and the channels
+type remotePeer struct {
+	*pion.PeerConnection
+	state *pion.DataChannel
+}
+
+func newRemote(t *testing.T) *remotePeer {
+	t.Helper()
+	connection, err := pion.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		t.Fatalf("cannot create the remote peer: %v", err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	remote := &remotePeer{PeerConnection: connection}
+	for _, kind := range []pion.RTPCodecType{pion.RTPCodecTypeVideo, pion.RTPCodecTypeAudio} {
+		if _, err := connection.AddTransceiverFromKind(kind, pion.RtpTransceiverInit{Direction: pion.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatalf("cannot add the %s transceiver: %v", kind, err)
+		}
+	}
+	if _, err := connection.CreateDataChannel(inputChannelLabel, nil); err != nil {
+		t.Fatalf("cannot create the input channel: %v", err)
+	}
+	if remote.state, err = connection.CreateDataChannel(stateChannelLabel, nil); err != nil {
+		t.Fatalf("cannot create the state channel: %v", err)
+	}
+	return remote
+}
+
+// offer returns the offer of the remote peer with its candidates
+func (r *remotePeer) offer(t *testing.T) string {
+	t.Helper()
+	gathered := pion.GatheringCompletePromise(r.PeerConnection)
+	offer, err := r.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("cannot create the offer: %v", err)
+	}
+	if err = r.SetLocalDescription(offer); err != nil {
+		t.Fatalf("cannot set the offer: %v", err)
+	}
+	<-gathered
+	return r.LocalDescription().SDP
+}
+
+// connect answers the offer of the remote peer and waits for the peer to connect
+func connect(t *testing.T, w *WebRTC, remote *remotePeer) {
+	t.Helper()
+	answer, err := w.AnswerClient(remote.offer(t), testConfig(), nil)
+	if err != nil {
+		t.Fatalf("cannot answer: %v", err)
+	}
+	if err = remote.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatalf("cannot set the answer: %v", err)
+	}
+	waitFor(t, "the peer to connect", w.IsConnected)
+}
+
+// waitFor fails the test if the condition isn't met in time
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(connectTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isDone(w *WebRTC) bool {
+	select {
+	case <-w.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPeerConnects(t *testing.T) {
+	w := NewWebRTC()
+	defer w.StopClient()
+	remote := newRemote(t)
+	tracks := make(chan pion.RTPCodecType, 2)
+	remote.OnTrack(func(track *pion.TrackRemote, _ *pion.RTPReceiver) {
+		tracks <- track.Kind()
+	})
+	messages := make(chan string, 1)
+	remote.state.OnMessage(func(msg pion.DataChannelMessage) {
+		messages <- string(msg.Data)
+	})
+
+	connect(t, w, remote)
+	if isDone(w) {
+		t.Fatal("a connected peer is done")
+	}
+
+	// the remote gets the track with its first packet
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96}, Payload: []byte{0x09, 0xf0}}
+	timeout := time.After(connectTimeout)
+	for got := false; !got; {
+		select {
+		case kind := <-tracks:
+			if kind != pion.RTPCodecTypeVideo {
+				t.Fatalf("the remote got a %s track, want video", kind)
+			}
+			got = true
+		case <-timeout:
+			t.Fatal("timed out waiting for the video track")
+		case <-time.After(10 * time.Millisecond):
+			packet.SequenceNumber++
+			w.ImageChannel <- &rtp.Packet{Header: packet.Header, Payload: packet.Payload}
+		}
+	}
+
+	waitFor(t, "the state channel to open", func() bool { return remote.state.ReadyState() == pion.DataChannelStateOpen })
+	if err := w.Send(MessageTitle, Title{Title: "app"}); err != nil {
+		t.Fatalf("cannot send: %v", err)
+	}
+	select {
+	case msg := <-messages:
+		if want := `{"type":"TITLE","data":{"title":"app"}}`; msg != want {
+			t.Errorf("the remote got %s, want %s", msg, want)
+		}
+	case <-time.After(connectTimeout):
+		t.Fatal("timed out waiting for the message")
+	}
+}
+
+func TestPeerConnectsWithOffer(t *testing.T) {
+	w := NewWebRTC()
+	defer w.StopClient()
+	remote := newRemote(t)
+
+	// the candidates of the peer trickle, the remote takes them once it has the offer
+	candidates := make(chan string, 100)
+	offer, err := w.StartClient(func(c string) { candidates <- c }, testConfig())
+	if err != nil {
+		t.Fatalf("cannot offer: %v", err)
+	}
+	sdp, err := DecodeSDP(offer)
+	if err != nil {
+		t.Fatalf("cannot decode the offer: %v", err)
+	}
+	if err = remote.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeOffer, SDP: sdp}); err != nil {
+		t.Fatalf("cannot set the offer: %v", err)
+	}
+	gathered := pion.GatheringCompletePromise(remote.PeerConnection)
+	answer, err := remote.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("cannot create the answer: %v", err)
+	}
+	if err = remote.SetLocalDescription(answer); err != nil {
+		t.Fatalf("cannot set the answer: %v", err)
+	}
+	<-gathered
+	encoded, err := EncodeAnswer(remote.LocalDescription().SDP)
+	if err != nil {
+		t.Fatalf("cannot encode the answer: %v", err)
+	}
+	if err = w.SetRemoteSDP(encoded); err != nil {
+		t.Fatalf("cannot set the remote answer: %v", err)
+	}
+	go func() {
+		for c := range candidates {
+			if c == "" {
+				return
+			}
+			var candidate pion.ICECandidateInit
+			if Decode(c, &candidate) == nil {
+				remote.AddICECandidate(candidate)
+			}
+		}
+	}()
+
+	waitFor(t, "the peer to connect", w.IsConnected)
+}
+
+func TestStopDuringConnect(t *testing.T) {
+	w := NewWebRTC()
+	remote := newRemote(t)
+	offer := remote.offer(t)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the stop may win the race, the answer fails then
+		if _, err := w.AnswerClient(offer, testConfig(), nil); err != nil && err != ErrPeerClosed {
+			t.Errorf("answer: %v", err)
+		}
+	}()
+	w.StopClient()
+	wg.Wait()
+
+	if !isDone(w) {
+		t.Fatal("a stopped peer isn't done")
+	}
+	if state := w.State(); state != PeerClosed {
+		t.Fatalf("the stopped peer is %s", state)
+	}
+	// a stopped peer can't be started again
+	if _, err := w.AnswerClient(offer, testConfig(), nil); err != ErrPeerClosed {
+		t.Fatalf("answer after stop: %v, want %v", err, ErrPeerClosed)
+	}
+}
+
+func TestStopClientTwice(t *testing.T) {
+	w := NewWebRTC()
+	var closed int32
+	w.OnClose = func() { atomic.AddInt32(&closed, 1) }
+	connect(t, w, newRemote(t))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.StopClient()
+		}()
+	}
+	wg.Wait()
+	w.StopClient()
+
+	if !isDone(w) {
+		t.Fatal("a stopped peer isn't done")
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Fatalf("OnClose was called %d times, want 1", n)
+	}
+}
+
+func TestSendAfterStop(t *testing.T) {
+	w := NewWebRTC()
+	connect(t, w, newRemote(t))
+
+	// the app keeps streaming while the peer stops
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			select {
+			case w.ImageChannel <- &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i)}}:
+			default:
+			}
+			select {
+			case w.AudioChannel <- &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i)}}:
+			default:
+			}
+		}
+	}()
+	w.StopClient()
+	<-done
+
+	if err := w.Send(MessageTitle, Title{Title: "app"}); err != ErrPeerClosed {
+		t.Fatalf("send after stop: %v, want %v", err, ErrPeerClosed)
+	}
+	if err := w.Send(MessagePing, Ping{ID: 1}); err != ErrPeerClosed {
+		t.Fatalf("lossy send after stop: %v, want %v", err, ErrPeerClosed)
+	}
+	if _, err := w.RestartICE(); err != ErrPeerClosed {
+		t.Fatalf("ICE restart after stop: %v, want %v", err, ErrPeerClosed)
+	}
+	if err := w.AddCandidate(""); err != ErrPeerClosed {
+		t.Fatalf("candidate after stop: %v, want %v", err, ErrPeerClosed)
+	}
+}
@@ -0,0 +1,283 @@
+package cloudapp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+// WHEP and WHIP style endpoints let players such as OBS, GStreamer or ffplay pull
+// the app stream with a single HTTP exchange of SDP, without the websocket.
+// The player POSTs its offer and gets the answer with all the server candidates,
+// the Location of the answer is the session. The player trickles its candidates
+// with PATCH and DELETEs the session to leave. The secret of the Location authorizes
+// them, the session ID alone is logged and isn't enough.
+//
+//   POST /whep[/{appID}]  watch only
+//   POST /whip[/{appID}]  play, the input data channel is forwarded to the app
+//   PATCH /whep/session/{sessionID}/{secret}  trickle ICE SDP fragment, RFC 8840
+//   DELETE /whep/session/{sessionID}/{secret}
+
+const (
+	sdpContentType     = "application/sdp"
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+)
+
+// maxSDPSize bounds the offer body
+const maxSDPSize = 64 << 10
+
+// peerAdmitTimeout bounds the wait for the app of a client signaled over HTTP.
+// It's below the write timeout of the HTTP server.
+const peerAdmitTimeout = 4 * time.Second
+
+var (
+	errServiceClosed = errors.New("the app is shutting down")
+	errServiceFull   = errors.New("the app has no free slot")
+	errAppNotReady   = errors.New("the app instance is not ready")
+)
+
+// AddPeerClient admits a client signaled over HTTP. There is no waiting queue,
+// the client is refused if there is no free slot.
+func (s *Service) AddPeerClient(userID string, viewOnly bool) (*Client, error) {
+	client := s.newClient(uuid.Must(uuid.NewV4()).String(), userID, nil)
+	client.viewOnly = viewOnly
+	secret, err := newPeerSecret()
+	if err != nil {
+		return nil, err
+	}
+	client.peerSecret = secret
+
+	s.clientsLock.Lock()
+	if s.isClosed() {
+		s.clientsLock.Unlock()
+		return nil, errServiceClosed
+	}
+	if s.isFull() {
+		s.clientsLock.Unlock()
+		return nil, errServiceFull
+	}
+	s.activity.Join()
+	s.sessions[client.sessionID] = client
+	s.admit(client)
+	s.clientsLock.Unlock()
+
+	// an ondemand instance is launched in background
+	select {
+	case <-client.admitted:
+		return client, nil
+	case <-time.After(peerAdmitTimeout):
+		s.RemoveClient(client.clientID)
+		return nil, errAppNotReady
+	}
+}
+
+// newPeerSecret returns an unguessable secret of a session resource
+func newPeerSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// peerSession returns the client signaled over HTTP of the session, nil if the session
+// is unknown, belongs to a websocket client or the secret doesn't match
+func (s *Service) peerSession(sessionID string, secret string) *Client {
+	s.clientsLock.Lock()
+	client, ok := s.sessions[sessionID]
+	s.clientsLock.Unlock()
+	if !ok || client.socket() != nil || client.peerSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(secret), []byte(client.peerSecret)) != 1 {
+		return nil
+	}
+	return client
+}
+
+// RemoveSession removes the client signaled over HTTP of the session, it returns false
+// if the session is unknown or the secret doesn't match
+func (s *Service) RemoveSession(sessionID string, secret string) bool {
+	client := s.peerSession(sessionID, secret)
+	if client == nil {
+		return false
+	}
+	s.RemoveClient(client.clientID)
+	return true
+}
+
+// answerOffer starts the peer of the client with the SDP offer and returns the SDP answer.
+// The client is removed when the peer stops.
+func (c *Client) answerOffer(offer string, remove func()) (string, error) {
+	peer := c.newPeer()
+	peer.OnClose = func() { go remove() }
+	c.setPeer(peer)
+	// the candidates of the server are in the answer, the player trickles with PATCH
+	answer, err := peer.AnswerClient(offer, c.webrtcConf, nil)
+	if err != nil {
+		return "", err
+	}
+	c.startPeer(peer)
+	return answer, nil
+}
+
+// WHEP serves a watch only session over HTTP signaling
+func (s *Server) WHEP(w http.ResponseWriter, r *http.Request) {
+	s.servePeer(w, r, "/whep", true)
+}
+
+// WHIP serves a session over HTTP signaling whose input is forwarded to the app
+func (s *Server) WHIP(w http.ResponseWriter, r *http.Request) {
+	s.servePeer(w, r, "/whip", false)
+}
+
+func (s *Server) servePeer(w http.ResponseWriter, r *http.Request, base string, viewOnly bool) {
+	if !s.allowCORS(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Accept-Post", sdpContentType)
+		w.Header().Set("Accept-Patch", sdpFragContentType)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app, ok := s.appOf(r)
+	if !ok {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "offer must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	claims, err := s.auth.Authenticate(r)
+	if err != nil {
+		app.capp.log.Warn("Refused an HTTP signaled client", "path", base, "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.AppID != "" && claims.AppID != app.id {
+		http.Error(w, "token is not valid for this app", http.StatusForbidden)
+		return
+	}
+	offer, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := app.capp.AddPeerClient(claims.Subject, viewOnly)
+	if err != nil {
+		app.capp.log.Info("Refused an HTTP signaled client", "path", base, "err", err)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	answer, err := client.answerOffer(string(offer), func() { app.capp.RemoveClient(client.clientID) })
+	if err != nil {
+		client.log.Warn("Cannot answer the offer", "err", err)
+		app.capp.RemoveClient(client.clientID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client.log.Info("Initialized an HTTP signaled client", "path", base, "role", client.role())
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", base+"/session/"+client.sessionID+"/"+client.peerSecret)
+	w.Header().Set("Accept-Patch", sdpFragContentType)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// PeerSession serves the session resource returned by WHEP and WHIP.
+// PATCH adds remote candidates, DELETE ends it.
+func (s *Server) PeerSession(w http.ResponseWriter, r *http.Request) {
+	if !s.allowCORS(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	vars := mux.Vars(r)
+	sessionID, secret := vars["sessionID"], vars["secret"]
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Accept-Patch", sdpFragContentType)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		s.trickle(w, r, sessionID, secret)
+	case http.MethodDelete:
+		for _, app := range s.apps {
+			if app.capp.RemoveSession(sessionID, secret) {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		http.Error(w, "session not found", http.StatusNotFound)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// trickle adds the candidates of the SDP fragment to the peer of the session
+func (s *Server) trickle(w http.ResponseWriter, r *http.Request, sessionID string, secret string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpFragContentType) {
+		http.Error(w, "candidates must be "+sdpFragContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	var client *Client
+	for _, app := range s.apps {
+		if client = app.capp.peerSession(sessionID, secret); client != nil {
+			break
+		}
+	}
+	if client == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	peer := client.peer()
+	if peer == nil {
+		http.Error(w, "session has no peer", http.StatusConflict)
+		return
+	}
+	frag, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := peer.AddSDPFragment(string(frag)); err != nil {
+		client.log.Warn("Cannot add the trickled candidates", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowCORS sets the CORS headers for browser players, it returns false if the origin isn't allowed
+func (s *Server) allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !s.auth.CheckOrigin(r) {
+		return false
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	h.Set("Access-Control-Expose-Headers", "Location, Accept-Post, Accept-Patch")
+	h.Add("Vary", "Origin")
+	return true
+}
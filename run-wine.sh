@@ -1,37 +1,51 @@
 #!/usr/bin/env bash
+# Optional per instance args, used by ondemand mode to run several apps side by side
+containername=${8:-appvm}
+videoport=${9:-5004}
+audioport=${10:-4004}
+inputport=${11:-9090}
+supervisorport=${12:-9001}
 cd winvm
 docker build -t syncwine .
-docker rm -f appvm
+docker rm -f "$containername"
 if [ $(uname -s) == "Darwin" ]
 then
     echo "Spawn container on Mac"
-    docker run -d --privileged --rm --name "appvm" \
+    dockerhost=${DOCKERHOST:-host.docker.internal}
+    sandbox=(--privileged \
     --mount type=bind,source="$(pwd)"/apps,target=/apps \
-    --mount type=bind,source="$(pwd)"/supervisord.conf,target=/etc/supervisor/conf.d/supervisord.conf  \
-    --env "apppath=$1" \
-    --env "appfile=$2" \
-    --env "appname=$3" \
-    --env "hwkey=$4" \
-    --env "screenwidth=$5" \
-    --env "screenheight=$6" \
-    --env "wineoptions=$7" \
-    --env "dockerhost=host.docker.internal" \
-    --env "DISPLAY=:99" \
-    --volume "winecfg:/root/.wine" syncwine supervisord
-else 
+    --mount type=bind,source="$(pwd)"/supervisord.conf,target=/etc/supervisor/conf.d/supervisord.conf \
+    --volume "winecfg:/root/.wine")
+else
     echo "Spawn container on Linux"
-    docker run -t -d --privileged --rm --name "appvm" \
+    dockerhost=${DOCKERHOST:-127.0.0.1}
+    sandbox=(-t --privileged \
     --mount type=bind,source="$(pwd)"/apps,target=/apps \
-    --mount type=bind,source="$(pwd)"/supervisord.conf,target=/etc/supervisor/conf.d/supervisord.conf  \
+    --mount type=bind,source="$(pwd)"/supervisord.conf,target=/etc/supervisor/conf.d/supervisord.conf \
     --network=host \
-    --env "apppath=$1" \
-    --env "appfile=$2" \
-    --env "appname=$3" \
-    --env "hwkey=$4" \
-    --env "screenwidth=$5" \
-    --env "screenheight=$6" \
-    --env "wineoptions=$7" \
-    --env "dockerhost=127.0.0.1" \
-    --env "DISPLAY=:99" \
-    --volume "winecfg:/root/.wine" syncwine supervisord
+    --volume "winecfg:/root/.wine")
 fi
+if [ $# -gt 12 ]
+then
+    # Sandbox from the server config: limits, privileges, network, mounts and published ports
+    sandbox=(-t "${@:13}")
+fi
+# Run in foreground so the server supervises the container, exec to forward signals
+exec docker run --rm --name "$containername" \
+"${sandbox[@]}" \
+--env "apppath=$1" \
+--env "appfile=$2" \
+--env "appname=$3" \
+--env "hwkey=$4" \
+--env "screenwidth=$5" \
+--env "screenheight=$6" \
+--env "wineoptions=$7" \
+--env "dockerhost=$dockerhost" \
+--env "displaysize=$DISPLAYSIZE" \
+--env "vcodec=${VCODEC:-h264}" \
+--env "videoport=$videoport" \
+--env "audioport=$audioport" \
+--env "inputport=$inputport" \
+--env "supervisorport=$supervisorport" \
+--env "DISPLAY=:99" \
+syncwine supervisord
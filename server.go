@@ -2,36 +2,39 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/giongto35/cloud-morph/pkg/addon/textchat"
+	"github.com/giongto35/cloud-morph/pkg/common/auth"
 	"github.com/giongto35/cloud-morph/pkg/common/config"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/logging"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
 	"github.com/giongto35/cloud-morph/pkg/common/ws"
 	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{}
-
-const configFilePath = "config.yaml"
-
-var curApp = "Notepad"
-
 const embedPage string = "web/embed/embed.html"
 const indexPage string = "web/index.html"
 const addr string = ":8080"
 
+// shutdownTimeout bounds the graceful shutdown
+const shutdownTimeout = 15 * time.Second
+
 var chatEventTypes = []string{"CHAT"}
 var appEventTypes = []string{"OFFER", "ANSWER", "MOUSEDOWN", "MOUSEUP", "MOUSEMOVE", "KEYDOWN", "KEYUP"}
 var dscvEventTypes = []string{"SELECTHOST"}
@@ -45,24 +48,32 @@ var clientID string
 // }
 
 type Server struct {
-	appID            string
 	httpServer       *http.Server
 	wsClients        map[string]*cws.Client
 	chat             *textchat.TextChat
 	discoveryHandler *discoveryHandler
-	appMeta          appDiscoveryMeta
-	cappServer       *cloudapp.Server
+	// cfg and the apps are replaced on reload
+	lock sync.Mutex
+	cfg  config.Config
+	// appIDs are the discovery IDs of the hosted apps in appMetas, the default app first
+	appIDs     []string
+	appMetas   []appDiscoveryMeta
+	cappServer *cloudapp.Server
+	auth       *auth.Authenticator
+	upgrader   websocket.Upgrader
 }
 
 type discoveryHandler struct {
 	httpClient    *http.Client
 	discoveryHost string
 	apps          []appDiscoveryMeta
+	log           *slog.Logger
 }
 
 // TODO: sync with discovery.go
 type appDiscoveryMeta struct {
 	ID           string `json:"id"`
+	AppID        string `json:"app_id,omitempty"` // ID in the catalog of the server
 	AppName      string `json:"app_name"`
 	Addr         string `json:"addr"`
 	AppMode      string `json:"app_mode"`
@@ -81,22 +92,34 @@ type initData struct {
 
 // WSO handles all connections from user/frontend to coordinator
 func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
-	log.Println("A user is connecting...")
+	slog.Debug("A user is connecting")
 	// defer func() {
 	// 	if r := recover(); r != nil {
 	// 		log.Println("Warn: Something wrong. Recovered in ", r)
 	// 	}
 	// }()
 
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		// TODO: can we be stricter?
-		return true
+	select {
+	case <-s.cappServer.Done():
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	default:
 	}
-	// be aware of ReadBufferSize, WriteBufferSize (default 4096)
+
+	claims, err := s.auth.Authenticate(r)
+	if err != nil {
+		slog.Warn("Refused a websocket", "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.Subject != "" {
+		slog.Info("Authenticated the user", "user", claims.Subject)
+	}
+
 	// https://pkg.go.dev/github.com/gorilla/websocket?tab=doc#Upgrader
-	c, err := upgrader.Upgrade(w, r, nil)
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Coordinator: [!] WS upgrade:", err)
+		slog.Warn("Cannot upgrade the websocket", "err", err)
 		return
 	}
 
@@ -108,37 +131,43 @@ func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
 	// DEPRECATED because we use external chat
 	// chatClient := s.chat.AddClient(clientID, wsClient)
 	// chatClient.Route()
-	log.Println("Initialized Chat")
 	// TODO: Update packet
 	// Add websocket client to app service
-	log.Println("Initialized ServiceClient")
+	wsClient.Logger().Info("Initialized the client")
 
 	s.initClientData(wsClient)
 	go func(browserClient *cws.Client) {
 		browserClient.Listen()
-		log.Println("Closing connection")
+		browserClient.Logger().Debug("Closing the connection")
 		// chatClient.Close()
 		browserClient.Close()
-		log.Println("Closed connection")
+		browserClient.Logger().Info("Closed the connection")
 	}(wsClient)
 }
 
 func (s *Server) initClientData(client *cws.Client) {
 	s.chat.SendChatHistory(client.GetID())
-	apps, err := s.GetApps()
-	if err != nil {
-		apps = []appDiscoveryMeta{}
-	}
+	s.lock.Lock()
 	data := initData{
-		CurAppID: s.appID,
-		App:      s.appMeta,
-		Apps:     apps,
+		CurAppID: s.appIDs[0],
+		App:      s.appMetas[0],
+		// without discovery, the list is the local catalog
+		Apps: append([]appDiscoveryMeta{}, s.appMetas...),
+	}
+	discoveryHost := s.cfg.DiscoveryHost
+	s.lock.Unlock()
+	if discoveryHost != "" {
+		apps, err := s.GetApps()
+		if err != nil {
+			apps = []appDiscoveryMeta{}
+		}
+		data.Apps = apps
 	}
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return
 	}
-	fmt.Println("Send Client INIT")
+	client.Logger().Debug("Sending INIT")
 	client.Send(cws.WSPacket{
 		Type: "INIT",
 		Data: string(jsonData),
@@ -154,18 +183,28 @@ func (s *Server) updateClientApps(client *cws.Client, updatedApps []appDiscovery
 }
 
 func (s *Server) registerIfMissing(updatedApps []appDiscoveryMeta) {
-	for _, app := range updatedApps {
-		if app.Addr == s.appMeta.Addr {
-			return
+	s.lock.Lock()
+	metas := append([]appDiscoveryMeta{}, s.appMetas...)
+	s.lock.Unlock()
+
+	for _, meta := range metas {
+		found := false
+		for _, app := range updatedApps {
+			if app.Addr == meta.Addr && app.AppID == meta.AppID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.discoveryHandler.log.Info("App is not found, registering it again", logging.KeyApp, meta.AppName)
+			s.RegisterApp(meta)
 		}
 	}
-	log.Println("Server is not found in Discovery. Re-Register")
-	s.RegisterApp(s.appMeta)
 }
 
 func (s *Server) ListenAppListUpdate() {
 	for updatedApps := range s.AppListUpdate() {
-		log.Println("Get updated apps: ", updatedApps, s.wsClients)
+		s.discoveryHandler.log.Debug("Updated the apps", "apps", updatedApps, "clients", len(s.wsClients))
 		for _, client := range s.wsClients {
 			s.updateClientApps(client, updatedApps)
 		}
@@ -173,16 +212,17 @@ func (s *Server) ListenAppListUpdate() {
 	}
 }
 
-func NewServer() *Server {
-	cfg, err := config.ReadConfig(configFilePath)
-	if err != nil {
-		panic(err)
-	}
-	log.Printf("Config: %+v", cfg)
+func NewServer(cfg config.Config) *Server {
+	slog.Debug("Starting the server", "config", cfg)
 
+	authenticator := auth.NewFromConfig(cfg.Auth)
 	server := &Server{
+		cfg:              cfg,
 		wsClients:        map[string]*cws.Client{},
 		discoveryHandler: NewDiscovery(cfg.DiscoveryHost),
+		auth:             authenticator,
+		// be aware of ReadBufferSize, WriteBufferSize (default 4096)
+		upgrader: websocket.Upgrader{CheckOrigin: authenticator.CheckOrigin},
 	}
 
 	r := mux.NewRouter()
@@ -198,7 +238,9 @@ func NewServer() *Server {
 		func(w http.ResponseWriter, r *http.Request) {
 			tmpl, err := template.ParseFiles(embedPage)
 			if err != nil {
-				log.Fatal(err)
+				slog.Error("Cannot parse the embed page", "page", embedPage, "err", err)
+				http.Error(w, "embed page is not available", http.StatusInternalServerError)
+				return
 			}
 
 			tmpl.Execute(w, nil)
@@ -207,7 +249,7 @@ func NewServer() *Server {
 	svmux := &http.ServeMux{}
 
 	// Spawn a separated server running CloudApp
-	log.Println("Spawn cloudapp server")
+	slog.Debug("Spawning the cloudapp server")
 	cappServer := cloudapp.NewServerWithHTTPServerMux(cfg, r, svmux)
 	server.cappServer = cappServer
 	cappServer.Handle()
@@ -216,10 +258,15 @@ func NewServer() *Server {
 		func(w http.ResponseWriter, r *http.Request) {
 			tmpl, err := template.ParseFiles(indexPage)
 			if err != nil {
-				log.Fatal(err)
+				slog.Error("Cannot parse the index page", "page", indexPage, "err", err)
+				http.Error(w, "index page is not available", http.StatusInternalServerError)
+				return
 			}
+			server.lock.Lock()
+			cfg := server.cfg
+			server.lock.Unlock()
 			if err := tmpl.Execute(w, cfg); err != nil {
-				log.Fatal(err)
+				slog.Warn("Cannot render the index page", "err", err)
 			}
 		},
 	)
@@ -237,24 +284,16 @@ func NewServer() *Server {
 	server.httpServer = httpServer
 
 	server.chat = textchat.NewTextChat()
-	appMeta := appDiscoveryMeta{
-		Addr:         cfg.InstanceAddr,
-		AppName:      cfg.AppName,
-		AppMode:      cfg.AppMode,
-		HasChat:      cfg.HasChat,
-		PageTitle:    cfg.PageTitle,
-		ScreenWidth:  cfg.ScreenWidth,
-		ScreenHeight: cfg.ScreenHeight,
-	}
-	fmt.Println("appMeta", appMeta)
-
-	appID, err := server.RegisterApp(appMeta)
-	if err != nil {
-		log.Println(err)
+	for _, meta := range cappServer.Apps() {
+		appMeta := appDiscoveryMeta(meta)
+		appID, err := server.RegisterApp(appMeta)
+		if err != nil {
+			server.discoveryHandler.log.Warn("Cannot register the app", logging.KeyApp, appMeta.AppName, "err", err)
+		}
+		server.appIDs = append(server.appIDs, appID)
+		server.appMetas = append(server.appMetas, appMeta)
+		server.discoveryHandler.log.Info("Registered the app", logging.KeyApp, appMeta.AppName, "id", appID)
 	}
-	server.appID = appID
-	server.appMeta = appMeta
-	log.Println("Registered with AppID", server.appID)
 
 	if cfg.DiscoveryHost != "" {
 		go server.ListenAppListUpdate()
@@ -262,11 +301,78 @@ func NewServer() *Server {
 	return server
 }
 
-func (o *Server) Shutdown() {
-	err := o.RemoveApp(o.appID)
-	if err != nil {
-		log.Println(err)
+// Reload applies the new config to the apps and the page, and updates the
+// apps in discovery if their meta changed
+func (o *Server) Reload(cfg config.Config) {
+	report := o.cappServer.Reload(cfg)
+	if !report.Changed() {
+		return
 	}
+
+	o.lock.Lock()
+	// fields needing a server restart keep their value
+	cfg.DiscoveryHost = o.cfg.DiscoveryHost
+	cfg.Auth = o.cfg.Auth
+	o.cfg = cfg
+	o.lock.Unlock()
+
+	for i, meta := range o.cappServer.Apps() {
+		appMeta := appDiscoveryMeta(meta)
+		o.lock.Lock()
+		if i >= len(o.appMetas) || appMeta == o.appMetas[i] {
+			o.lock.Unlock()
+			continue
+		}
+		oldName := o.appMetas[i].AppName
+		o.appMetas[i] = appMeta
+		appID := o.appIDs[i]
+		o.lock.Unlock()
+
+		if cfg.DiscoveryHost == "" {
+			continue
+		}
+		if err := o.RemoveApp(appID); err != nil {
+			o.discoveryHandler.log.Warn("Cannot remove the app", logging.KeyApp, oldName, "err", err)
+		}
+		metrics.DiscoveryRegistered.DeleteLabelValues(oldName)
+		appID, err := o.RegisterApp(appMeta)
+		if err != nil {
+			o.discoveryHandler.log.Warn("Cannot register the app", logging.KeyApp, appMeta.AppName, "err", err)
+			continue
+		}
+		o.lock.Lock()
+		o.appIDs[i] = appID
+		o.lock.Unlock()
+		o.discoveryHandler.log.Info("Registered the app again", logging.KeyApp, appMeta.AppName, "id", appID)
+	}
+}
+
+// Shutdown closes the clients and the app, deregisters from discovery and
+// stops the HTTP server once its requests are done or ctx expires
+func (o *Server) Shutdown(ctx context.Context) error {
+	// cloudapp server stops accepting clients first, then closes them and the app
+	if err := o.cappServer.Shutdown(ctx); err != nil {
+		slog.Warn("Cannot shut down the cloudapp server", "err", err)
+	}
+	for _, client := range o.wsClients {
+		client.Send(cws.WSPacket{Type: "SHUTDOWN"}, nil)
+		client.Close()
+	}
+
+	o.lock.Lock()
+	discoveryHost := o.cfg.DiscoveryHost
+	appIDs := append([]string{}, o.appIDs...)
+	appMetas := append([]appDiscoveryMeta{}, o.appMetas...)
+	o.lock.Unlock()
+	if discoveryHost != "" {
+		for i, appID := range appIDs {
+			if err := o.RemoveApp(appID); err != nil {
+				o.discoveryHandler.log.Warn("Cannot remove the app", logging.KeyApp, appMetas[i].AppName, "err", err)
+			}
+			metrics.DiscoveryRegistered.WithLabelValues(appMetas[i].AppName).Set(0)
+		}
+	}
+	return o.httpServer.Shutdown(ctx)
 }
 
 func (o *Server) Handle() {
@@ -275,7 +381,7 @@ func (o *Server) Handle() {
 }
 
 func (o *Server) ListenAndServe() error {
-	log.Println("Server is running at", addr)
+	slog.Info("Server is running", "addr", addr)
 	return o.httpServer.ListenAndServe()
 }
 
@@ -286,10 +392,10 @@ func monitor() {
 		Addr:    fmt.Sprintf(":%d", 3535),
 		Handler: monitoringServerMux,
 	}
-	log.Println("Starting monitoring server at", srv.Addr)
+	slog.Info("Starting the monitoring server", "addr", srv.Addr)
 
 	pprofPath := fmt.Sprintf("/debug/pprof")
-	log.Println("Profiling is enabled at", srv.Addr+pprofPath)
+	slog.Info("Profiling is enabled", "addr", srv.Addr+pprofPath)
 	monitoringServerMux.Handle(pprofPath+"/", http.HandlerFunc(pprof.Index))
 	monitoringServerMux.Handle(pprofPath+"/cmdline", http.HandlerFunc(pprof.Cmdline))
 	monitoringServerMux.Handle(pprofPath+"/profile", http.HandlerFunc(pprof.Profile))
@@ -303,6 +409,8 @@ func monitor() {
 	monitoringServerMux.Handle(pprofPath+"/heap", pprof.Handler("heap"))
 	monitoringServerMux.Handle(pprofPath+"/mutex", pprof.Handler("mutex"))
 	monitoringServerMux.Handle(pprofPath+"/threadcreate", pprof.Handler("threadcreate"))
+	slog.Info("Metrics are enabled", "addr", srv.Addr+"/metrics")
+	monitoringServerMux.Handle("/metrics", metrics.Handler())
 	go srv.ListenAndServe()
 
 }
@@ -311,23 +419,53 @@ func main() {
 	// HTTP server
 	// TODO: Make the communication over websocket
 	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(config.ValidateCommand(os.Args[0], os.Args[2:], os.Stdout))
+	}
+	configPath, overrides, err := config.ParseFlags(os.Args[0], os.Args[1:], os.Stderr)
+	if err != nil {
+		os.Exit(2)
+	}
+	cfg, err := config.Load(configPath, overrides)
+	if err != nil {
+		slog.Error("Cannot load the config", "err", err)
+		os.Exit(1)
+	}
+	logging.Setup(cfg.Log)
+
 	monitor()
-	server := NewServer()
+	server := NewServer(cfg)
 	server.Handle()
 
+	watcher := config.NewWatcher(configPath, overrides)
+	defer watcher.Close()
+	go func() {
+		for cfg := range watcher.Updates() {
+			server.Reload(cfg)
+		}
+	}()
+
 	go func() {
 		err := server.ListenAndServe()
-		if err != nil {
-			log.Fatal(err)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	select {
-	case <-stop:
-		log.Println("Received SIGTERM, Quiting")
-		server.Shutdown()
+	case sig := <-stop:
+		slog.Info("Received a signal, quitting", "signal", sig.String())
+	case <-server.cappServer.Done():
+		slog.Info("App is shut down, quitting")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Shutdown failed", "err", err)
 	}
 }
 
@@ -362,13 +500,14 @@ func NewDiscovery(discoveryHost string) *discoveryHandler {
 			Timeout: time.Second * 10,
 		},
 		discoveryHost: discoveryHost,
+		log:           slog.With("discovery", discoveryHost),
 	}
 }
 
 func (s *Server) GetAppsHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := s.GetApps()
 	if err != nil {
-		log.Println(err)
+		s.discoveryHandler.log.Warn("Cannot get the apps", "err", err)
 	}
 
 	appsJSON, _ := json.Marshal(apps)
@@ -386,11 +525,17 @@ func (s *Server) GetApps() ([]appDiscoveryMeta, error) {
 }
 
 func (s *Server) RegisterApp(meta appDiscoveryMeta) (string, error) {
-	return s.discoveryHandler.Register(meta)
+	appID, err := s.discoveryHandler.Register(meta)
+	registered := 0.0
+	if err == nil && appID != "" {
+		registered = 1
+	}
+	metrics.DiscoveryRegistered.WithLabelValues(meta.AppName).Set(registered)
+	return appID, err
 }
 
 func (s *Server) RemoveApp(appID string) error {
-	return s.discoveryHandler.Remove(s.appID)
+	return s.discoveryHandler.Remove(appID)
 }
 
 func (s *Server) AppListUpdate() chan []appDiscoveryMeta {
@@ -437,11 +582,11 @@ func (d *discoveryHandler) AppListUpdate() chan []appDiscoveryMeta {
 		for range time.Tick(5 * time.Second) {
 			newApps, err := d.GetApps()
 			if err != nil {
-				log.Println(err)
+				d.log.Warn("Cannot get the apps", "err", err)
 				continue
 			}
 			if d.isNeedAppListUpdate(newApps) {
-				log.Println("Update AppHosts: ", newApps)
+				d.log.Info("The apps changed", "apps", newApps)
 				updatedApps <- newApps
 				d.apps = make([]appDiscoveryMeta, len(newApps))
 				copy(d.apps, newApps)
@@ -11,6 +11,7 @@
   const appd = document.getElementById("app");
   const appTitle = document.getElementById("app-title");
   const appScreen = document.getElementById("app-screen");
+  const appStats = document.getElementById("app-stats");
 
   var offerst;
 
@@ -80,7 +81,7 @@
   };
 
   const onMouseMove = (data) => {
-    rtcp.input(
+    rtcp.motion(
       JSON.stringify({
         type: "MOUSEMOVE",
         data: JSON.stringify(data),
@@ -88,7 +89,49 @@
     );
   };
 
+  // Ctrl+Shift+S toggles the stats overlay, it's not sent to the app
+  const isStatsToggle = (e) => e.ctrlKey && e.shiftKey && e.code === "KeyS";
+
+  const showLatency = (report) => {
+    if (!appStats || appStats.hidden) return;
+    const fmt = (v) => (v || 0).toFixed(1);
+    appStats.textContent = [
+      `ping ${fmt(report.ping.last_ms)} ms (avg ${fmt(report.ping.avg_ms)}, max ${fmt(report.ping.max_ms)})`,
+      `dispatch ${fmt(report.dispatch.avg_ms)} ms`,
+      `rtt ${fmt(report.network_rtt_ms)} ms, jitter ${fmt(report.jitter_ms)} ms`,
+      `input to photon ~${fmt(report.input_to_photon_ms)} ms + render`,
+    ].join("\n");
+  };
+
+  if (appStats) appStats.hidden = !new URLSearchParams(location.search).has("stats");
+
+  // A player resizing the page, ex. going fullscreen, resizes the app to fit it within
+  // the bounds of the server. The bounds come with the screen size, see SCREEN_RESIZED.
+  const resizeDelayMs = 500;
+  let appSize = null;
+  let isPlayer = false;
+  let resizeTimer;
+  const even = (v) => v - (v % 2);
+  const clamp = (v, min, max) => Math.min(Math.max(v, min || 0), max || v);
+  const fitScreen = () => {
+    if (!isPlayer || !appSize || !appSize.resize) return;
+    const { minWidth, minHeight, maxWidth, maxHeight } = appSize.resize;
+    const width = even(clamp(Math.floor(window.innerWidth), minWidth, maxWidth));
+    const height = even(clamp(Math.floor(window.innerHeight), minHeight, maxHeight));
+    if (width === appSize.width && height === appSize.height) return;
+    event.pub(SCREEN_RESIZE_REQUESTED, { width, height });
+  };
+  window.addEventListener("resize", () => {
+    clearTimeout(resizeTimer);
+    resizeTimer = setTimeout(fitScreen, resizeDelayMs);
+  });
+
   document.addEventListener("keydown", (e) => {
+    if (isStatsToggle(e)) {
+      e.preventDefault();
+      event.pub(STATS_TOGGLE);
+      return;
+    }
     //if (
       //document.activeElement === username ||
       //document.activeElement === chatmessage
@@ -99,6 +142,7 @@
   });
 
   document.addEventListener("keyup", (e) => {
+    if (isStatsToggle(e)) return;
     //if (
       //document.activeElement === username ||
       //document.activeElement === chatmessage
@@ -108,6 +152,11 @@
     event.pub(KEY_RELEASED, { key: e.keyCode });
   });
 
+  // scaleMode tells the server how the video is displayed, to map the mouse to the app screen
+  const scaleModes = { contain: "fit", cover: "fill", fill: "stretch", none: "1:1" };
+  const scaleMode = () =>
+    scaleModes[getComputedStyle(appScreen).objectFit] || "fit";
+
   appScreen.addEventListener("mousedown", (e) => {
     boundRect = appScreen.getBoundingClientRect();
     event.pub(MOUSE_DOWN, {
@@ -116,6 +165,7 @@
       y: e.offsetY,
       width: boundRect.width,
       height: boundRect.height,
+      mode: scaleMode(),
     });
   });
 
@@ -127,6 +177,7 @@
       y: e.offsetY,
       width: boundRect.width,
       height: boundRect.height,
+      mode: scaleMode(),
     });
   });
 
@@ -138,6 +189,7 @@
       y: e.clientY - boundRect.top,
       width: boundRect.width,
       height: boundRect.height,
+      mode: scaleMode(),
     });
   });
 
@@ -157,12 +209,55 @@
   event.sub(MEDIA_STREAM_SDP_AVAILABLE, (data) =>
     rtcp.setRemoteDescription(data.sdp, appScreen)
   );
+  event.sub(MEDIA_STREAM_ANSWER_AVAILABLE, (data) =>
+    rtcp.setRemoteAnswer(data.sdp, appScreen)
+  );
   event.sub(MEDIA_STREAM_CANDIDATE_ADD, (data) =>
     rtcp.addCandidate(data.candidate)
   );
   event.sub(MEDIA_STREAM_CANDIDATE_FLUSH, () => rtcp.flushCandidate());
   event.sub(MEDIA_STREAM_READY, () => rtcp.start());
   event.sub(CONNECTION_READY, onConnectionReady);
+  event.sub(QUEUE_POSITION, ({ position }) =>
+    log.info(`[control] server is full, you are #${position} in the queue`)
+  );
+  event.sub(CLIENT_ROLE, ({ role }) => {
+    log.info(`[control] joined as ${role}`);
+    isPlayer = role === "player";
+  });
+  event.sub(SCREEN_RESIZE_REQUESTED, ({ width, height }) => {
+    const resize = { type: "RESIZE", data: JSON.stringify({ width, height }) };
+    if (!rtcp.control(JSON.stringify(resize))) socket.resize(width, height);
+  });
+  event.sub(SCREEN_RESIZED, (size) => {
+    const { width, height } = size;
+    appSize = size;
+    log.info(`[control] screen is ${width}x${height}`);
+    appScreen.style.aspectRatio = `${width} / ${height}`;
+  });
+  event.sub(APP_STATUS_CHANGED, ({ name, state, restarts }) =>
+    log.info(`[control] app ${name} is ${state} (restarts: ${restarts})`)
+  );
+  event.sub(CURSOR_UPDATED, ({ shape, visible }) => {
+    appScreen.style.cursor = visible ? shape || "default" : "none";
+  });
+  event.sub(WINDOW_TITLE_CHANGED, ({ title }) => {
+    document.title = title;
+  });
+  event.sub(CLIPBOARD_RECEIVED, ({ text }) => {
+    // the page needs the focus and the permission of the user
+    if (navigator.clipboard) {
+      navigator.clipboard.writeText(text).catch((err) => log.debug(`[control] clipboard: ${err}`));
+    }
+  });
+  event.sub(PING_RECEIVED, (ping) => {
+    // echo the ping, the server measures the round trip
+    rtcp.control(JSON.stringify({ type: "PONG", data: JSON.stringify(ping) }));
+  });
+  event.sub(LATENCY_REPORTED, showLatency);
+  event.sub(STATS_TOGGLE, () => {
+    if (appStats) appStats.hidden = !appStats.hidden;
+  });
   //event.sub(NUM_PLAYER, ({ data }) => updateNumPlayers(data));
   //event.sub(CLIENT_INIT, ({ data }) => {
     //initApps(JSON.parse(data));
@@ -29,7 +29,7 @@
     app = appList[discoverydropdown.selectedIndex];
     curAppID = app.id;
       socket.connect("http", `${app.addr}/wscloudmorph`);
-      appContainer.setAttribute("src", `${location.protocol}//${app.addr}/embed`);
+      appContainer.setAttribute("src", `${location.protocol}//${app.addr}/embed${app.app_id ? `/${app.app_id}` : ""}`);
     updatePage(app);
   });
 
@@ -69,9 +69,21 @@ const CONNECTION_CLOSED = "connectionClosed";
 
 const CHAT = "chat";
 const NUM_PLAYER = "num_player";
+const QUEUE_POSITION = "queuePosition";
+const CLIENT_ROLE = "clientRole";
+const SCREEN_RESIZE_REQUESTED = "screenResizeRequested";
+const SCREEN_RESIZED = "screenResized";
+
+const APP_STATUS_CHANGED = "appStatusChanged";
+const CURSOR_UPDATED = "cursorUpdated";
+const WINDOW_TITLE_CHANGED = "windowTitleChanged";
+const CLIPBOARD_RECEIVED = "clipboardReceived";
+const PING_RECEIVED = "pingReceived";
+const LATENCY_REPORTED = "latencyReported";
 
 const MEDIA_STREAM_INITIALIZED = "mediaStreamInitialized";
 const MEDIA_STREAM_SDP_AVAILABLE = "mediaStreamSdpAvailable";
+const MEDIA_STREAM_ANSWER_AVAILABLE = "mediaStreamAnswerAvailable";
 const MEDIA_STREAM_CANDIDATE_ADD = "mediaStreamCandidateAdd";
 const MEDIA_STREAM_CANDIDATE_FLUSH = "mediaStreamCandidateFlush";
 const MEDIA_STREAM_READY = "mediaStreamReady";
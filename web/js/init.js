@@ -1 +1,4 @@
-socket.connect(location.protocol, `${location.host}/ws`);
+const token = new URLSearchParams(location.search).get("token");
+// /embed/<appID> streams an app of the server catalog
+const embedApp = location.pathname.match(/^\/embed\/([A-Za-z0-9_-]+)/);
+socket.connect(location.protocol, `${location.host}/ws${embedApp ? `/${embedApp[1]}` : ""}${token ? `?token=${encodeURIComponent(token)}` : ""}`);
@@ -1 +1,2 @@
-socket.connect(location.protocol, `${location.host}/wscloudmorph`);
+const token = new URLSearchParams(location.search).get("token");
+socket.connect(location.protocol, `${location.host}/wscloudmorph${token ? `?token=${encodeURIComponent(token)}` : ""}`);
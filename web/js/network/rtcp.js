@@ -4,7 +4,14 @@
  */
 const rtcp = (() => {
     let connection;
+    // keys and clicks, ordered and reliable
     let inputChannel;
+    // mouse moves, unordered without retransmits
+    let motionChannel;
+    // control messages of the session
+    let controlChannel;
+    // the messages of the server, see onServerMessage
+    let stateChannel;
     let mediaStream;
     let candidates = Array();
     let isAnswered = false;
@@ -13,32 +20,96 @@ const rtcp = (() => {
     let connected = false;
     let inputReady = false;
 
-    const start = (iceservers) => {
-        log.info("[rtcp] <- received STUN/TURN config from the worker", iceservers);
+    // ?offer=client makes the browser offer, the server answers
+    const clientOffer = new URLSearchParams(location.search).get("offer") === "client";
+    // local candidates wait for the answer when the browser offers
+    let localCandidates = [];
 
-        let conf
-        if (iceservers !== "") {
-            conf = {
-                iceservers: {urls: iceservers}
-            }
+    const openInput = (channel) => {
+        inputChannel = channel;
+        inputChannel.onopen = () => {
+            log.debug("[rtcp] the input channel has opened");
+            inputReady = true;
+            event.pub(CONNECTION_READY);
+        };
+        inputChannel.onclose = () => {
+            inputReady = false;
+            log.debug("[rtcp] the input channel has closed");
         }
+    };
 
-        connection = conf ? new RTCPeerConnection(conf) : new RTCPeerConnection();
+    // the server pushes {type, data} messages on the state and motion channels
+    const onServerMessage = (e) => {
+        let message;
+        try {
+            message = JSON.parse(e.data);
+        } catch (err) {
+            log.error("[rtcp] bad server message", err);
+            return;
+        }
+        const data = message.data || {};
+        switch (message.type) {
+            case "APPSTATUS":
+                event.pub(APP_STATUS_CHANGED, data);
+                break;
+            case "CURSOR":
+                event.pub(CURSOR_UPDATED, data);
+                break;
+            case "TITLE":
+                event.pub(WINDOW_TITLE_CHANGED, data);
+                break;
+            case "CLIPBOARD":
+                event.pub(CLIPBOARD_RECEIVED, data);
+                break;
+            case "PING":
+                event.pub(PING_RECEIVED, data);
+                break;
+            case "LATENCY":
+                event.pub(LATENCY_REPORTED, data);
+                break;
+        }
+    };
+
+    const openChannel = (channel) => {
+        switch (channel.label) {
+            case "app-input":
+                openInput(channel);
+                break;
+            case "app-motion":
+                motionChannel = channel;
+                motionChannel.onmessage = onServerMessage;
+                break;
+            case "app-control":
+                controlChannel = channel;
+                break;
+            case "app-state":
+                stateChannel = channel;
+                stateChannel.onmessage = onServerMessage;
+                break;
+        }
+    };
+
+    const isOpen = (channel) => channel && channel.readyState === "open";
+
+    const sendCandidate = (candidate) => socket.send({type: "candidate", data: btoa(candidate)});
+
+    const start = (iceservers) => {
+        log.info("[rtcp] <- received STUN/TURN config from the worker", iceservers);
+
+        // the list of RTCIceServer with the TURN credentials of this user
+        const iceServers = iceservers ? JSON.parse(iceservers) : [];
+        // the server starts over when the previous peer is gone
+        if (connection) connection.close();
+        candidates = [];
+        localCandidates = [];
+        isAnswered = false;
+        connection = new RTCPeerConnection({iceServers: iceServers});
 
         mediaStream = new MediaStream();
 
         connection.ondatachannel = (e) => {
             log.debug(`[rtcp] ondatachannel: ${e.channel.label}`);
-            inputChannel = e.channel;
-            inputChannel.onopen = () => {
-                log.debug("[rtcp] the input channel has opened");
-                inputReady = true;
-                event.pub(CONNECTION_READY);
-            };
-            inputChannel.onclose = () => {
-                inputReady = false;
-                log.debug("[rtcp] the input channel has closed");
-            }
+            openChannel(e.channel);
         };
 
         connection.oniceconnectionstatechange = ice.onIceConnectionStateChange;
@@ -48,7 +119,21 @@ const rtcp = (() => {
             mediaStream.addTrack(event.track);
         };
 
-        socket.send({type: "initwebrtc"});
+        if (!clientOffer) {
+            socket.send({type: "initwebrtc"});
+            return;
+        }
+        openChannel(connection.createDataChannel("app-input"));
+        openChannel(connection.createDataChannel("app-motion", {ordered: false, maxRetransmits: 0}));
+        openChannel(connection.createDataChannel("app-control"));
+        openChannel(connection.createDataChannel("app-state"));
+        connection.addTransceiver("video", {direction: "recvonly"});
+        connection.addTransceiver("audio", {direction: "recvonly"});
+        connection
+            .createOffer()
+            .then((offer) => connection.setLocalDescription(offer).then(() => offer))
+            .then((offer) => socket.send({type: "offer", data: btoa(JSON.stringify(offer))}))
+            .catch(log.error);
     };
 
     const ice = (() => {
@@ -62,7 +147,11 @@ const rtcp = (() => {
                 if (event.candidate != null) {
                     const candidate = JSON.stringify(event.candidate);
                     log.info('[rtcp] got ice candidate', candidate);
-                    socket.send({type: "candidate", data: btoa(candidate)});
+                    if (clientOffer && !isAnswered) {
+                        localCandidates.push(candidate);
+                    } else {
+                        sendCandidate(candidate);
+                    }
                 }
             },
             onIceStateChange: (event) => {
@@ -97,12 +186,8 @@ const rtcp = (() => {
                     case "failed": {
                         log.error("[rtcp] connection failed, retry...");
                         connected = false;
-                        connection
-                            .createOffer({iceRestart: true})
-                            .then((description) =>
-                                connection.setLocalDescription(description).catch(log.error)
-                            )
-                            .catch(log.error);
+                        // the server is the offerer, it sends an ICE restart offer
+                        socket.send({type: "iceRestart"});
                         break;
                     }
                 }
@@ -129,6 +214,18 @@ const rtcp = (() => {
 
             media.srcObject = mediaStream;
         },
+        // the answer of the server when the browser offers
+        setRemoteAnswer: async (data, media) => {
+            const answer = new RTCSessionDescription(JSON.parse(atob(data)));
+            await connection.setRemoteDescription(answer);
+
+            isAnswered = true;
+            localCandidates.forEach(sendCandidate);
+            localCandidates = [];
+            event.pub(MEDIA_STREAM_CANDIDATE_FLUSH);
+
+            media.srcObject = mediaStream;
+        },
         addCandidate: (data) => {
             if (data === "") {
                 event.pub(MEDIA_STREAM_CANDIDATE_FLUSH);
@@ -145,12 +242,30 @@ const rtcp = (() => {
                 log.debug("[rtcp] add candidate", d);
                 connection.addIceCandidate(candidate).catch(log.error);
             });
+            // an ICE restart brings new candidates
+            candidates = [];
             isFlushing = false;
         },
         input: (data) => {
             if (inputChannel) inputChannel.send(data);
         },
+        // a lost move is superseded by the next one
+        motion: (data) => {
+            if (isOpen(motionChannel)) {
+                motionChannel.send(data);
+            } else if (inputChannel) {
+                inputChannel.send(data);
+            }
+        },
+        // returns false if the control channel is not open
+        control: (data) => {
+            if (!isOpen(controlChannel)) return false;
+            controlChannel.send(data);
+            return true;
+        },
         isConnected: () => connected,
         isInputReady: () => inputReady,
+        // returns true if the page still holds a peer to resume
+        hasPeer: () => !!connection && connection.signalingState !== "closed",
     };
 })(event, socket, log);
@@ -26,13 +26,28 @@ const socket = (() => {
   const pingIntervalMs = 2000; // 2 secs
   // const pingIntervalMs = 1000 / 5; // too much
 
+  // a dropped connection is resumed with the session of the server within its grace
+  const sessionKey = "cloudmorph.session";
+  const minReconnectMs = 1000;
+  const maxReconnectMs = 10000;
+
   let conn;
   let curPacketId = "";
+  let pingInterval;
+  let reconnectMs = minReconnectMs;
+  // no reconnect once the server is gone or the session is resumed elsewhere
+  let isFinal = false;
 
   const connect = (protocol, addr) => {
     // const params = new URLSearchParams({room_id: roomId, zone: zone}).toString()
     // const address = `${location.protocol !== 'https:' ? 'ws' : 'wss'}://${location.host}/ws`;
-    const address = `${protocol !== "https:" ? "ws" : "wss"}://${addr}`;
+    const session = sessionStorage.getItem(sessionKey);
+    // a reloaded page keeps the session but not the peer, the server starts a new one
+    const query = session
+      ? `${addr.includes("?") ? "&" : "?"}session=${encodeURIComponent(session)}` +
+        `&peer=${typeof rtcp !== "undefined" && rtcp.hasPeer() ? 1 : 0}`
+      : "";
+    const address = `${protocol !== "https:" ? "ws" : "wss"}://${addr}${query}`;
     console.info(`[ws] connecting to ${address}`);
     conn = new WebSocket(address);
 
@@ -40,11 +55,19 @@ const socket = (() => {
     conn.onopen = () => {
       log.info("[ws] <- open connection");
       log.info(`[ws] -> setting ping interval to ${pingIntervalMs}ms`);
-      // !to add destructor if SPA
-      setInterval(ping, pingIntervalMs);
+      reconnectMs = minReconnectMs;
+      clearInterval(pingInterval);
+      pingInterval = setInterval(ping, pingIntervalMs);
     };
     conn.onerror = (error) => log.error(`[ws] ${error}`);
-    conn.onclose = () => log.info("[ws] closed");
+    conn.onclose = () => {
+      log.info("[ws] closed");
+      clearInterval(pingInterval);
+      if (isFinal) return;
+      log.info(`[ws] reconnecting in ${reconnectMs}ms`);
+      setTimeout(() => connect(protocol, addr), reconnectMs);
+      reconnectMs = Math.min(reconnectMs * 2, maxReconnectMs);
+    };
     // Message received from server
     conn.onmessage = (response) => {
       const data = JSON.parse(response.data);
@@ -61,6 +84,10 @@ const socket = (() => {
           // this is offer from worker
           event.pub(MEDIA_STREAM_SDP_AVAILABLE, { sdp: data.data });
           break;
+        case "answer":
+          // the worker answers the offer of the browser
+          event.pub(MEDIA_STREAM_ANSWER_AVAILABLE, { sdp: data.data });
+          break;
         case "candidate":
           event.pub(MEDIA_STREAM_CANDIDATE_ADD, { candidate: data.data });
           break;
@@ -80,6 +107,30 @@ const socket = (() => {
         case "NUMPLAYER":
           event.pub(NUM_PLAYER, { numplayers: data.data });
           break;
+        case "QUEUE":
+          event.pub(QUEUE_POSITION, { position: parseInt(data.data) });
+          break;
+        case "IDLE":
+          log.info(`[ws] <- the session is idle (${data.data})`);
+          break;
+        case "SHUTDOWN":
+          log.info("[ws] <- the server is shutting down");
+          isFinal = true;
+          sessionStorage.removeItem(sessionKey);
+          break;
+        case "SESSION":
+          sessionStorage.setItem(sessionKey, data.data);
+          break;
+        case "SESSION_MOVED":
+          log.info("[ws] <- the session is resumed on another connection");
+          isFinal = true;
+          break;
+        case "RESIZE":
+          event.pub(SCREEN_RESIZED, JSON.parse(data.data));
+          break;
+        case "ROLE":
+          event.pub(CLIENT_ROLE, { role: data.data });
+          break;
         case "INIT":
           event.pub(CLIENT_INIT, { data: data.data });
           break;
@@ -96,13 +147,19 @@ const socket = (() => {
     send({ id: "heartbeat", data: time.toString() });
     event.pub(PING_REQUEST, { time: time });
   };
-  const send = (data) => conn.send(JSON.stringify(data));
+  const send = (data) => {
+    // dropped while reconnecting, the server resumes the session
+    if (conn.readyState === WebSocket.OPEN) conn.send(JSON.stringify(data));
+  };
   const latency = (workers, packetId) =>
     send({
       id: "checkLatency",
       data: JSON.stringify(workers),
       packet_id: packetId,
     });
+  // asks the app to change its screen size, players only
+  const resize = (width, height) =>
+    send({ type: "RESIZE", data: JSON.stringify({ width, height }) });
   // const start = (appName, isMobile) =>
   //   send({
   //     id: "start",
@@ -116,6 +173,7 @@ const socket = (() => {
   return {
     send: send,
     latency: latency,
+    resize: resize,
     // start: start,
     connect: connect,
     // quit: quit,
@@ -0,0 +1,38 @@
+#!/usr/bin/env bash
+# Virtual display of the app and its video stream, run by supervisord
+#   display.sh xvfb        start the display, large enough for $displaysize when resizing is on
+#   display.sh stream      stream the screen to $dockerhost:$videoport, encoded with $vcodec (h264 or vpx)
+#   display.sh resize W H  change the screen size and restart the stream
+# Without $displaysize the display stays 800x600 and the stream captures its top-left screenwidth x screenheight.
+export DISPLAY=:99
+sizefile=/tmp/screensize
+
+case "$1" in
+xvfb)
+    rm -f "$sizefile"
+    exec /usr/bin/Xvfb :99 -screen 0 "${displaysize:-800x600}x16"
+    ;;
+stream)
+    size=$(cat "$sizefile" 2>/dev/null || echo "${screenwidth}x${screenheight}")
+    if [ -n "$displaysize" ]
+    then
+        # The app gets the screen size as its desktop
+        xrandr --fb "$size" || echo "Cannot resize the display, streaming its top-left $size"
+    fi
+    if [ "$vcodec" == "vpx" ]
+    then
+        encoder=(-c:v libvpx -deadline realtime -quality realtime)
+    else
+        encoder=(-tune zerolatency -c:v libx264 -quality realtime)
+    fi
+    exec ffmpeg -r 30 -f x11grab -draw_mouse 0 -s "$size" -i :99 -pix_fmt yuv420p "${encoder[@]}" -f rtp "rtp://${dockerhost}:${videoport}"
+    ;;
+resize)
+    echo "${2}x${3}" > "$sizefile"
+    exec supervisorctl -s unix:///var/tmp/supervisor.sock restart ffmpeg
+    ;;
+*)
+    echo "usage: $0 xvfb|stream|resize W H" >&2
+    exit 2
+    ;;
+esac
@@ -16,6 +16,7 @@ HWND hwnd;
 char *winTitle;
 char dockerHost[20];
 string hardcodeIP;
+int inputPort = 9090;
 bool isMac;
 bool isWindows;
 
@@ -25,6 +26,12 @@ const byte MOUSE_UP = 2;
 const byte KEY_UP = 0;
 const byte KEY_DOWN = 1;
 
+// isIPAddress returns true if the host is a dotted IPv4 address
+bool isIPAddress(const string &host)
+{
+    return host != "" && inet_addr(host.c_str()) != INADDR_NONE;
+}
+
 int clientConnect()
 {
     WSADATA wsa_data;
@@ -35,7 +42,7 @@ int clientConnect()
     int server = socket(AF_INET, SOCK_STREAM, 0);
 
     addr.sin_family = AF_INET;
-    addr.sin_port = htons(9090);
+    addr.sin_port = htons(inputPort);
     if (isMac)
     {
         // Mac doesn't have host mode in docker, hence need to get local docker address
@@ -60,17 +67,15 @@ int clientConnect()
         cout << "ip from hostname: " << ip << endl;
         addr.sin_addr.s_addr = inet_addr(ip);
     }
+    else if (isIPAddress(hardcodeIP))
+    {
+        // the host of the server, ex. the gateway of the sandbox network
+        cout << "Running with hardcode IP " << hardcodeIP << endl;
+        addr.sin_addr.s_addr = inet_addr(hardcodeIP.c_str());
+    }
     else if (isWindows)
     {
-        if (hardcodeIP != "")
-        {
-            cout << "Running with hardcode IP" << hardcodeIP << endl;
-            addr.sin_addr.s_addr = inet_addr(hardcodeIP.c_str());
-        }
-        else
-        {
-            addr.sin_addr.s_addr = inet_addr("127.0.0.1");
-        }
+        addr.sin_addr.s_addr = inet_addr("127.0.0.1");
     }
     else
     {
@@ -380,6 +385,16 @@ int main(int argc, char *argv[])
     {
         hardcodeIP = argv[4];
     }
+    if (!isIPAddress(hardcodeIP) && argc > 3 && isIPAddress(argv[3]))
+    {
+        // the docker host is the server
+        hardcodeIP = argv[3];
+    }
+    if (argc > 5)
+    {
+        // Each app instance listens input at its own port
+        inputPort = atoi(argv[5]);
+    }
 
     server = clientConnect();
 